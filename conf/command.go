@@ -0,0 +1,291 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	SAMPLE_HTTP_SERVER_CONF = `# 配置语法是toml
+# 监听端口 默认8080
+port=8080
+# 开启动态路由 post的数据会上传到默认uri对应的文件, get会按照路径动态获取文件, 默认是true
+dynamic_route=true
+# db根目录 默认是http-server-root
+db_root="http-server-root"
+# 健康检查路径 默认是/health 和 /ready
+# health_path="/health"
+# ready_path="/ready"
+
+[topic]
+# 路径变量, 和/topics共用topics.json
+path="/topics/{id}"
+unique_not_list=true
+
+[topic_post]
+path="/topics"
+method="post"
+# 新数据的id和已有的数据重复时返回409
+id=["id"]
+`
+
+	SAMPLE_DATA_FILE = "topics.json"
+
+	SAMPLE_DATA = `{
+  "data": [
+    {"id": "1", "title": "hello smock"}
+  ]
+}
+`
+)
+
+type (
+	// dataFile is a data file referenced by a server, and the resolver it's read by
+	dataFile struct {
+		file     string
+		resolver HttpFileResolver
+	}
+)
+
+// parseHttpServers parses every configured http server as a dry run, the invalid ones are reported by the callback
+func parseHttpServers(invalid func(file string, err error)) ([]*HttpServer, error) {
+	files := httpServerFiles()
+	if len(files) == 0 {
+		return nil, errNoConf
+	}
+	if err := checkOverrides(files); err != nil {
+		invalid("overrides", err)
+		return nil, err
+	}
+
+	servers := make([]*HttpServer, 0, len(files))
+	errs := make([]error, 0)
+	for _, file := range files {
+		server, err := parseHttpServer(file, true)
+		if err != nil {
+			invalid(file, err)
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return servers, errors.Join(errs...)
+}
+
+// sites returns the default site and the virtual hosts sorted by name
+func (server *HttpServer) sites() ([]string, []*HttpServer) {
+	names := make([]string, 0, len(server.Hosts))
+	for name := range server.Hosts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sites := []*HttpServer{server}
+	for _, name := range names {
+		sites = append(sites, server.Hosts[name])
+	}
+	return append([]string{"*"}, names...), sites
+}
+
+// dataFiles returns the data files of the static routes and the ones in the db roots
+func (server *HttpServer) dataFiles() ([]dataFile, error) {
+	files := make([]dataFile, 0)
+	seen := make(map[string]bool)
+	add := func(file string, resolver HttpFileResolver) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, dataFile{file: file, resolver: resolver})
+		}
+	}
+
+	_, sites := server.sites()
+	for _, site := range sites {
+		keys := make([]string, 0, len(site.StaticRoutes))
+		for key := range site.StaticRoutes {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if route := site.StaticRoutes[key]; !route.Raw && route.Resolver != nil {
+				add(route.File, route.Resolver)
+			}
+		}
+
+		if !FileExists(site.DBRoot) {
+			continue
+		}
+		err := filepath.WalkDir(site.DBRoot, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if ft, ok := FileExtMap[strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")]; ok {
+				add(path, ft.Resolver)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// Validate parses every configured http server and the data files of them, the problems are written to w
+func Validate(w io.Writer) error {
+	problems := 0
+	servers, err := parseHttpServers(func(file string, err error) {
+		problems++
+		fmt.Fprintf(w, "%s: %s\n", file, err.Error())
+	})
+	if errors.Is(err, errNoConf) {
+		return err
+	}
+
+	for _, server := range servers {
+		files, err := server.dataFiles()
+		if err != nil {
+			problems++
+			fmt.Fprintf(w, "%s: %s\n", server.ConfigFile, err.Error())
+			continue
+		}
+
+		invalid := 0
+		for _, df := range files {
+			data, err := os.ReadFile(df.file)
+			if errors.Is(err, fs.ErrNotExist) {
+				// created by the first request
+				continue
+			}
+			if err == nil {
+				var model HttpFileModel
+				err = df.resolver.Unmarshal(data, &model)
+			}
+			if err != nil {
+				invalid++
+				fmt.Fprintf(w, "%s: %s: %s\n", server.ConfigFile, df.file, err.Error())
+			}
+		}
+
+		if invalid == 0 {
+			fmt.Fprintf(w, "%s: ok, %d route(s), %d data file(s)\n", server.ConfigFile, server.routeCount(), len(files))
+		}
+		problems += invalid
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	return nil
+}
+
+func (server *HttpServer) routeCount() int {
+	count := len(server.StaticRoutes)
+	for _, vhost := range server.Hosts {
+		count += len(vhost.StaticRoutes)
+	}
+	return count
+}
+
+// Routes writes the static routes of every configured http server
+func Routes(w io.Writer) error {
+	servers, err := parseHttpServers(func(file string, err error) {})
+	if err != nil {
+		return err
+	}
+
+	for i, server := range servers {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintln(w, server.Summary())
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tMETHOD\tPATH\tACTION\tFORMAT\tFILE\tOPTIONS")
+
+		names, sites := server.sites()
+		for j, site := range sites {
+			keys := make([]string, 0, len(site.StaticRoutes))
+			for key := range site.StaticRoutes {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+
+			for _, key := range keys {
+				route := site.StaticRoutes[key]
+				action := ""
+				if route.Action != nil {
+					action = route.Action.Name
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", names[j], strings.TrimPrefix(key, route.Path+"_"),
+					route.Path, action, route.format(), route.File, strings.Join(route.options(), ","))
+			}
+		}
+
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// options describes the options of the route which change how it responds
+func (route Route) options() []string {
+	options := make([]string, 0)
+	if route.Protocol != "" {
+		options = append(options, route.Protocol)
+	}
+	if route.Single {
+		options = append(options, "single")
+	}
+	if len(route.Id) > 0 {
+		options = append(options, "id="+strings.Join(route.Id, "|"))
+	}
+	if len(route.Fields) > 0 {
+		options = append(options, "fields="+strings.Join(route.Fields, "|"))
+	}
+	if route.Stream != "" {
+		options = append(options, "stream="+route.Stream)
+	}
+	if route.Listing {
+		options = append(options, "listing")
+	}
+	if route.Auth != nil && !route.Auth.Disabled {
+		options = append(options, "auth")
+	}
+	if route.RateLimit != nil && !route.RateLimit.Disabled {
+		options = append(options, "rate_limit")
+	}
+	if route.RequestSchema != nil || route.ReplySchema != nil {
+		options = append(options, "openapi")
+	}
+	return options
+}
+
+// Init writes a sample config and db root to the dir
+func Init(dir string) error {
+	confFile := filepath.Join(dir, DEFAULT_HTTP_SERVER_CONF)
+	if FileExists(confFile) {
+		return fmt.Errorf("%s already exists", confFile)
+	}
+
+	root := filepath.Join(dir, DEFAULT_HTTP_ROOT)
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return err
+	}
+
+	sample := filepath.Join(root, SAMPLE_DATA_FILE)
+	if !FileExists(sample) {
+		if err := os.WriteFile(sample, []byte(SAMPLE_DATA), 0o644); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(confFile, []byte(SAMPLE_HTTP_SERVER_CONF), 0o644)
+}
@@ -1,13 +1,30 @@
 package conf
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_HTTP_SERVER_CONF = "http.server.conf"
+
+	// the timeout of stopping the started servers when another one fails to start
+	STOP_TIMEOUT             = 5 * time.Second
+	HTTP_SERVER_CONF_PATTERN = "*.http.server.conf"
 )
 
 var (
-	httpServer = flag.String("http-server", "http.server.conf", "http server config")
+	httpServer    = &fileList{files: []string{DEFAULT_HTTP_SERVER_CONF}}
+	httpServerDir = flag.String("http-server-dir", "", "directory of "+HTTP_SERVER_CONF_PATTERN+" files, one http server for each")
 	// TODO
 	tcpServer  = flag.String("tcp-server", "tcp.server.conf", "tcp server config")
 	udpServer  = flag.String("udp-server", "udp.server.conf", "udp server config")
@@ -18,14 +35,72 @@ var (
 
 type (
 	ServerConfig interface {
-		Listen()
+		Listen() error
+		Stop(ctx context.Context) error
+		Summary() string
 	}
 
 	ClientConfig interface {
 		Start()
+		Stop(ctx context.Context) error
+		Summary() string
 	}
+
+	// fileList is a repeatable file flag, the default is dropped once it's set
+	fileList struct {
+		files []string
+		set   bool
+	}
+)
+
+var (
+	running = make([]any, 0)
+
+	errNoConf = errors.New("no conf file found")
 )
 
+func init() {
+	flag.Var(httpServer, "http-server", "http server config, repeatable")
+}
+
+func (list *fileList) String() string {
+	return strings.Join(list.files, ",")
+}
+
+func (list *fileList) Set(file string) error {
+	if !list.set {
+		list.files, list.set = nil, true
+	}
+	list.files = append(list.files, file)
+	return nil
+}
+
+// httpServerFiles returns the http server config files from the flags,
+// the default one is not used if -http-server-dir is given without -http-server
+func httpServerFiles() []string {
+	files := make([]string, 0)
+	if httpServer.set || *httpServerDir == "" {
+		for _, file := range httpServer.files {
+			if FileExists(file) {
+				files = append(files, file)
+			} else if httpServer.set {
+				log.Printf("http server config not found: %s", file)
+			}
+		}
+	}
+
+	if *httpServerDir != "" {
+		matched, err := filepath.Glob(filepath.Join(*httpServerDir, HTTP_SERVER_CONF_PATTERN))
+		if err != nil {
+			log.Printf("http server config dir error: %s", err.Error())
+		}
+		sort.Strings(matched)
+		files = append(files, matched...)
+	}
+
+	return files
+}
+
 func FileExists(file string) bool {
 	_, err := os.Stat(file)
 	if err == nil {
@@ -34,31 +109,116 @@ func FileExists(file string) bool {
 	return os.IsExist(err)
 }
 
-func ParseAndRun() {
+// ParseAndRun starts every configured server and client, nothing is started if a config is invalid or there is none
+func ParseAndRun() error {
 	configs := make([]any, 0)
+	errs := make([]error, 0)
+
+	files := httpServerFiles()
+	if err := checkOverrides(files); err != nil {
+		errs = append(errs, err)
+	}
 
-	if FileExists(*httpServer) {
-		server, err := parseHttpServer(*httpServer)
+	ports := make(map[int]string)
+	for _, file := range files {
+		server, err := parseHttpServer(file, false)
 		if err != nil {
-			log.Printf("parse error: %s", err.Error())
-		} else {
-			configs = append(configs, server)
+			errs = append(errs, fmt.Errorf("%s: %w", file, err))
+			continue
 		}
+		if other, ok := ports[server.Port]; ok {
+			errs = append(errs, fmt.Errorf("%s: port %d is already used by %s", file, server.Port, other))
+			continue
+		}
+
+		// the first server decides the format of the other logs
+		if len(configs) == 0 {
+			slog.SetDefault(server.logger)
+		}
+
+		ports[server.Port] = file
+		configs = append(configs, server)
 	}
 
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
 	if len(configs) == 0 {
-		log.Printf("no conf file found, exiting... %s", "\n\n")
-		flag.Usage()
-		return
+		return errNoConf
 	}
 
-	for _, config := range configs {
+	// a server is in the summary only when it's listening
+	summary := make([]string, 0, len(configs))
+	for i, config := range configs {
 		switch conf := config.(type) {
 		case ServerConfig:
-			conf.Listen()
+			if err := conf.Listen(); err != nil {
+				// the ones already started are stopped, nothing is left running
+				running = configs[:i]
+				ctx, cancel := context.WithTimeout(context.Background(), STOP_TIMEOUT)
+				defer cancel()
+				return errors.Join(err, Stop(ctx))
+			}
+			summary = append(summary, conf.Summary())
 		case ClientConfig:
 			conf.Start()
+			summary = append(summary, conf.Summary())
+		}
+	}
+	log.Printf("started %d mock(s):\n  %s", len(configs), strings.Join(summary, "\n  "))
+
+	running = configs
+	return nil
+}
+
+// Stop stops every running server and client
+func Stop(ctx context.Context) error {
+	errs := make([]error, 0)
+	for _, config := range running {
+		switch conf := config.(type) {
+		case ServerConfig:
+			errs = append(errs, conf.Stop(ctx))
+		case ClientConfig:
+			errs = append(errs, conf.Stop(ctx))
+		}
+	}
+
+	running = running[:0]
+	return errors.Join(errs...)
+}
+
+// Import generates route sections and data files from other api descriptions,
+// e.g. import openapi spec.yaml, import postman collection.json, import har log.har
+func Import(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: import openapi|postman|har <file>")
+	}
+
+	root := DEFAULT_HTTP_ROOT
+	if files := httpServerFiles(); len(files) > 0 {
+		server, err := parseHttpServer(files[0], true)
+		if err != nil {
+			return err
+		}
+		root = server.DBRoot
+	}
+
+	switch args[0] {
+	case "openapi":
+		return ImportOpenApi(args[1], root, os.Stdout)
+	case "postman":
+		exchanges, err := LoadPostman(args[1])
+		if err != nil {
+			return err
+		}
+		return ImportExchanges(exchanges, root, os.Stdout)
+	case "har":
+		exchanges, err := LoadHar(args[1])
+		if err != nil {
+			return err
 		}
+		return ImportExchanges(exchanges, root, os.Stdout)
 	}
 
+	return fmt.Errorf("unknown import format: %s", args[0])
 }
@@ -0,0 +1,48 @@
+package conf
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/zddava/gowrap/json"
+)
+
+const (
+	ADMIN_PATH_PREFIX     = "/__smock/"
+	ADMIN_PATH_OPENAPI    = ADMIN_PATH_PREFIX + "openapi.json"
+	ADMIN_PATH_HEALTH     = ADMIN_PATH_PREFIX + "health"
+	ADMIN_PATH_RATE_LIMIT = ADMIN_PATH_PREFIX + "ratelimit"
+)
+
+// serveAdmin handles the builtin endpoints of smock, returns false if the request is not one of them
+func (server *HttpServer) serveAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, ADMIN_PATH_PREFIX) {
+		return false
+	}
+
+	switch r.URL.Path {
+	case ADMIN_PATH_OPENAPI:
+		server.serveOpenApi(w, r)
+	case ADMIN_PATH_HEALTH:
+		server.serveHealthAdmin(w, r)
+	case ADMIN_PATH_RATE_LIMIT:
+		server.serveRateLimitAdmin(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+
+	return true
+}
+
+// writeJson writes the value as the json response of the builtin endpoints
+func writeJson(w http.ResponseWriter, code int, v any) {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", MIME_TYPE_JSON)
+	w.WriteHeader(code)
+	w.Write(bytes)
+}
@@ -0,0 +1,417 @@
+package conf
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zddava/gowrap/json"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	KEY_AUTH = "auth"
+
+	DEFAULT_AUTH_REALM     = "smock"
+	DEFAULT_API_KEY_HEADER = "X-API-Key"
+
+	JWT_ALG_HS256 = "HS256"
+	JWT_ALG_RS256 = "RS256"
+)
+
+type (
+	// AuthOptions describes the credentials accepted by a site or a route, any of them is enough
+	AuthOptions struct {
+		Realm string `toml:"realm,omitempty"`
+		// user name to password
+		BasicUsers   map[string]string `toml:"basic_users,omitempty"`
+		BearerTokens []string          `toml:"bearer_tokens,omitempty"`
+		ApiKeys      []string          `toml:"api_keys,omitempty"`
+		// the header of the api key, the default is X-API-Key
+		ApiKeyHeader string `toml:"api_key_header,omitempty"`
+		// the query parameter of the api key, not accepted in the query if it's empty
+		ApiKeyQuery string      `toml:"api_key_query,omitempty"`
+		Jwt         *JwtOptions `toml:"jwt,omitempty"`
+		// query parameter to claim, the verified claims are matched against the data like the query
+		ClaimQuery map[string]string `toml:"claim_query,omitempty"`
+		// turns off the auth of the site for a route
+		Disabled bool `toml:"disabled,omitempty"`
+	}
+
+	// JwtOptions describes how the bearer jwt is verified
+	JwtOptions struct {
+		// the key of HS256
+		Secret string `toml:"secret,omitempty"`
+		// the pem file of the public key or certificate of RS256
+		PublicKey string   `toml:"public_key,omitempty"`
+		Issuer    string   `toml:"issuer,omitempty"`
+		Audience  []string `toml:"audience,omitempty"`
+		// the claims required, a 403 is responded if they don't match
+		Claims map[string]any `toml:"claims,omitempty"`
+		// seconds of clock skew allowed for exp and nbf
+		Leeway int64 `toml:"leeway,omitempty"`
+		// verify the tokens issued by the [oauth] server of smock
+		OAuth bool `toml:"oauth,omitempty"`
+
+		rsaKey *rsa.PublicKey
+	}
+
+	// authError is responded as 401 with the challenge, or 403 if the credentials are valid but not enough
+	authError struct {
+		code    int
+		message string
+	}
+
+	// claimsKey is the context key of the verified claims
+	claimsKey struct{}
+)
+
+var (
+	// {{claims.sub}} in the responses
+	claimPattern = regexp.MustCompile(`\{\{\s*claims\.([A-Za-z0-9_:.-]+?)\s*\}\}`)
+)
+
+func (err *authError) Error() string {
+	return err.message
+}
+
+func unauthorized(format string, args ...any) *authError {
+	return &authError{code: http.StatusUnauthorized, message: fmt.Sprintf(format, args...)}
+}
+
+func forbidden(format string, args ...any) *authError {
+	return &authError{code: http.StatusForbidden, message: fmt.Sprintf(format, args...)}
+}
+
+// compile loads the keys of the auth options
+func (auth *AuthOptions) compile() error {
+	if auth.Jwt == nil || auth.Jwt.PublicKey == "" {
+		return nil
+	}
+
+	pemBytes, err := os.ReadFile(auth.Jwt.PublicKey)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return fmt.Errorf("no pem block found in %s", auth.Jwt.PublicKey)
+	}
+
+	var key any
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("not a rsa public key: %s", auth.Jwt.PublicKey)
+	}
+	auth.Jwt.rsaKey = rsaKey
+	return nil
+}
+
+// auth returns the auth options of the route, the route's own ones take precedence
+func (route Route) auth(site *HttpServer) *AuthOptions {
+	auth := site.Auth
+	if route.Auth != nil {
+		auth = route.Auth
+	}
+	if auth == nil || auth.Disabled {
+		return nil
+	}
+	return auth
+}
+
+// authenticate checks the credentials of the request, the claims are returned if they are verified
+func (auth *AuthOptions) authenticate(r *http.Request) (map[string]any, *authError) {
+	if user, password, ok := r.BasicAuth(); ok && len(auth.BasicUsers) > 0 {
+		expected, found := auth.BasicUsers[user]
+		if !found || subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 {
+			return nil, unauthorized("invalid user or password")
+		}
+		return map[string]any{"sub": user}, nil
+	}
+
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && (len(auth.BearerTokens) > 0 || auth.Jwt != nil) {
+		token = strings.TrimSpace(token)
+		for _, expected := range auth.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) == 1 {
+				return map[string]any{}, nil
+			}
+		}
+		if auth.Jwt == nil {
+			return nil, unauthorized("invalid token")
+		}
+		return auth.Jwt.verify(token)
+	}
+
+	if len(auth.ApiKeys) > 0 {
+		header := auth.ApiKeyHeader
+		if header == "" {
+			header = DEFAULT_API_KEY_HEADER
+		}
+		key := r.Header.Get(header)
+		if key == "" && auth.ApiKeyQuery != "" {
+			key = r.URL.Query().Get(auth.ApiKeyQuery)
+		}
+		if key != "" {
+			for _, expected := range auth.ApiKeys {
+				if subtle.ConstantTimeCompare([]byte(expected), []byte(key)) == 1 {
+					return map[string]any{}, nil
+				}
+			}
+			return nil, unauthorized("invalid api key")
+		}
+	}
+
+	return nil, unauthorized("credentials required")
+}
+
+// challenge writes the WWW-Authenticate headers of the configured schemes
+func (auth *AuthOptions) challenge(w http.ResponseWriter, err *authError) {
+	realm := auth.Realm
+	if realm == "" {
+		realm = DEFAULT_AUTH_REALM
+	}
+
+	if len(auth.BasicUsers) > 0 {
+		w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
+	}
+	if len(auth.BearerTokens) > 0 || auth.Jwt != nil {
+		if err.code == http.StatusForbidden {
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="insufficient_scope"`, realm))
+		} else {
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s", error="invalid_token", error_description="%s"`, realm, err.message))
+		}
+	}
+}
+
+// claimValues adds the verified claims to the query values by claim_query
+func (auth *AuthOptions) claimValues(values url.Values, claims map[string]any) url.Values {
+	if len(auth.ClaimQuery) == 0 {
+		return values
+	}
+
+	merged := make(url.Values, len(values)+len(auth.ClaimQuery))
+	for k, v := range values {
+		merged[k] = v
+	}
+	for param, claim := range auth.ClaimQuery {
+		if value, ok := claims[claim]; ok {
+			merged[param] = []string{valueString(reflect.ValueOf(value))}
+		} else {
+			// a missing claim matches nothing
+			merged[param] = []string{}
+		}
+	}
+	return merged
+}
+
+// withClaims keeps the verified claims in the request for the response templates
+func withClaims(r *http.Request, claims map[string]any) *http.Request {
+	if len(claims) == 0 {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims))
+}
+
+// fillClaims replaces the {{claims.name}} placeholders in the strings of the response with the verified claims,
+// a string which is only a placeholder takes the claim as it is, e.g. a list, a missing claim is empty
+func fillClaims(r *http.Request, data any) any {
+	claims, _ := r.Context().Value(claimsKey{}).(map[string]any)
+	if len(claims) == 0 {
+		return data
+	}
+	return fillValue(data, claims)
+}
+
+func fillValue(data any, claims map[string]any) any {
+	switch d := data.(type) {
+	case string:
+		if match := claimPattern.FindStringSubmatch(d); match != nil && match[0] == d {
+			if claim, ok := claims[match[1]]; ok {
+				return claim
+			}
+			return ""
+		}
+		return claimPattern.ReplaceAllStringFunc(d, func(s string) string {
+			if claim, ok := claims[claimPattern.FindStringSubmatch(s)[1]]; ok {
+				return valueString(reflect.ValueOf(claim))
+			}
+			return ""
+		})
+	case map[string]any:
+		filled := make(map[string]any, len(d))
+		for k, v := range d {
+			filled[k] = fillValue(v, claims)
+		}
+		return filled
+	case []any:
+		filled := make([]any, len(d))
+		for i, v := range d {
+			filled[i] = fillValue(v, claims)
+		}
+		return filled
+	}
+	return data
+}
+
+// withoutApiKey removes the api key from the query values, so that it's not matched against the data
+func (auth *AuthOptions) withoutApiKey(values url.Values) url.Values {
+	if auth.ApiKeyQuery == "" || !values.Has(auth.ApiKeyQuery) {
+		return values
+	}
+
+	trimmed := make(url.Values, len(values))
+	for k, v := range values {
+		if k != auth.ApiKeyQuery {
+			trimmed[k] = v
+		}
+	}
+	return trimmed
+}
+
+// verify checks the signature and the claims of the jwt
+func (opts *JwtOptions) verify(token string) (map[string]any, *authError) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, unauthorized("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, unauthorized("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, unauthorized("malformed token signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == JWT_ALG_HS256 && opts.Secret != "":
+		mac := hmac.New(sha256.New, []byte(opts.Secret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, unauthorized("invalid signature")
+		}
+	case header.Alg == JWT_ALG_RS256 && opts.rsaKey != nil:
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(opts.rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, unauthorized("invalid signature")
+		}
+	default:
+		return nil, unauthorized("unsupported alg: %s", header.Alg)
+	}
+
+	claims := make(map[string]any)
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, unauthorized("malformed token claims")
+	}
+	return claims, opts.check(claims)
+}
+
+// check checks the registered claims and the required ones
+func (opts *JwtOptions) check(claims map[string]any) *authError {
+	now := time.Now().Unix()
+	if exp, ok := claims["exp"].(float64); ok && now > int64(exp)+opts.Leeway {
+		return unauthorized("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < int64(nbf)-opts.Leeway {
+		return unauthorized("token not valid yet")
+	}
+	if opts.Issuer != "" && claims["iss"] != opts.Issuer {
+		return unauthorized("invalid issuer")
+	}
+	if len(opts.Audience) > 0 {
+		matched := false
+		for _, aud := range claimStrings(claims["aud"]) {
+			if slices.Contains(opts.Audience, aud) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return unauthorized("invalid audience")
+		}
+	}
+
+	for name, expected := range opts.Claims {
+		actual, ok := claims[name]
+		if !ok {
+			return forbidden("claim %s required", name)
+		}
+		if !claimMatch(actual, expected) {
+			return forbidden("claim %s not allowed", name)
+		}
+	}
+	return nil
+}
+
+// claimMatch checks the claim against the expected value, every expected item is required if it's a list,
+// space separated claims like scope are treated as lists
+func claimMatch(actual, expected any) bool {
+	have := claimStrings(actual)
+	if s, ok := actual.(string); ok {
+		have = append(strings.Fields(s), s)
+	}
+
+	for _, want := range claimStrings(expected) {
+		if !slices.Contains(have, want) {
+			return false
+		}
+	}
+	return true
+}
+
+// claimStrings returns the claim as a list of strings, e.g. aud is either a string or a list
+func claimStrings(claim any) []string {
+	switch c := claim.(type) {
+	case nil:
+		return nil
+	case []any:
+		list := make([]string, 0, len(c))
+		for _, item := range c {
+			list = append(list, valueString(reflect.ValueOf(item)))
+		}
+		return list
+	default:
+		return []string{valueString(reflect.ValueOf(c))}
+	}
+}
+
+func decodeJwtPart(part string, v any) error {
+	bytes, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bytes, v)
+}
@@ -0,0 +1,266 @@
+package conf
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+// signJwt signs the claims with HS256, or RS256 if the key is given
+func signJwt(t *testing.T, claims map[string]any, key *rsa.PrivateKey) string {
+	t.Helper()
+
+	alg := JWT_ALG_HS256
+	if key != nil {
+		alg = JWT_ALG_RS256
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	if key != nil {
+		digest := sha256.Sum256([]byte(signed))
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		mac := hmac.New(sha256.New, []byte(testSecret))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthenticate(t *testing.T) {
+	auth := &AuthOptions{
+		BasicUsers:   map[string]string{"alice": "pw"},
+		BearerTokens: []string{"static-token"},
+		ApiKeys:      []string{"key-1"},
+		ApiKeyQuery:  "api_key",
+	}
+
+	tests := []struct {
+		name   string
+		setup  func(r *http.Request)
+		query  string
+		code   int
+		claims map[string]any
+	}{
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "pw") }, "", 0, map[string]any{"sub": "alice"}},
+		{"basic wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "px") }, "", http.StatusUnauthorized, nil},
+		{"basic password prefix", func(r *http.Request) { r.SetBasicAuth("alice", "p") }, "", http.StatusUnauthorized, nil},
+		{"basic unknown user", func(r *http.Request) { r.SetBasicAuth("bob", "pw") }, "", http.StatusUnauthorized, nil},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer static-token") }, "", 0, map[string]any{}},
+		{"bearer wrong", func(r *http.Request) { r.Header.Set("Authorization", "Bearer static-tokem") }, "", http.StatusUnauthorized, nil},
+		{"api key header", func(r *http.Request) { r.Header.Set(DEFAULT_API_KEY_HEADER, "key-1") }, "", 0, map[string]any{}},
+		{"api key query", func(r *http.Request) {}, "api_key=key-1", 0, map[string]any{}},
+		{"api key wrong", func(r *http.Request) { r.Header.Set(DEFAULT_API_KEY_HEADER, "key-2") }, "", http.StatusUnauthorized, nil},
+		{"no credentials", func(r *http.Request) {}, "", http.StatusUnauthorized, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/?"+tt.query, nil)
+			tt.setup(r)
+
+			claims, err := auth.authenticate(r)
+			if tt.code != 0 {
+				if err == nil || err.code != tt.code {
+					t.Fatalf("error = %v, want %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %s", err.message)
+			}
+			if !reflect.DeepEqual(claims, tt.claims) {
+				t.Errorf("claims = %v, want %v", claims, tt.claims)
+			}
+		})
+	}
+}
+
+func TestJwtVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	opts := &JwtOptions{
+		Secret:   testSecret,
+		Issuer:   "smock",
+		Audience: []string{"orders"},
+		Claims:   map[string]any{"scope": "orders:read", "roles": []any{"admin"}},
+		Leeway:   5,
+		rsaKey:   &key.PublicKey,
+	}
+	valid := func(overrides map[string]any) map[string]any {
+		claims := map[string]any{"sub": "alice", "iss": "smock", "aud": "orders", "exp": now + 60,
+			"scope": "orders:read orders:write", "roles": []any{"admin", "user"}}
+		for k, v := range overrides {
+			if v == nil {
+				delete(claims, k)
+			} else {
+				claims[k] = v
+			}
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token func() string
+		code  int
+	}{
+		{"hs256", func() string { return signJwt(t, valid(nil), nil) }, 0},
+		{"rs256", func() string { return signJwt(t, valid(nil), key) }, 0},
+		{"rs256 other key", func() string { return signJwt(t, valid(nil), other) }, http.StatusUnauthorized},
+		{"tampered", func() string {
+			token := signJwt(t, valid(nil), nil)
+			forged := signJwt(t, valid(map[string]any{"sub": "mallory"}), nil)
+			return forged[:len(forged)-43] + token[len(token)-43:]
+		}, http.StatusUnauthorized},
+		{"alg none", func() string {
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+			payload, _ := json.Marshal(valid(nil))
+			return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+		}, http.StatusUnauthorized},
+		{"malformed", func() string { return "not.a-jwt" }, http.StatusUnauthorized},
+		{"expired", func() string { return signJwt(t, valid(map[string]any{"exp": now - 60}), nil) }, http.StatusUnauthorized},
+		{"expired within leeway", func() string { return signJwt(t, valid(map[string]any{"exp": now - 2}), nil) }, 0},
+		{"not valid yet", func() string { return signJwt(t, valid(map[string]any{"nbf": now + 60}), nil) }, http.StatusUnauthorized},
+		{"wrong issuer", func() string { return signJwt(t, valid(map[string]any{"iss": "other"}), nil) }, http.StatusUnauthorized},
+		{"audience list", func() string { return signJwt(t, valid(map[string]any{"aud": []any{"x", "orders"}}), nil) }, 0},
+		{"wrong audience", func() string { return signJwt(t, valid(map[string]any{"aud": "payments"}), nil) }, http.StatusUnauthorized},
+		{"missing claim", func() string { return signJwt(t, valid(map[string]any{"roles": nil}), nil) }, http.StatusForbidden},
+		{"insufficient scope", func() string { return signJwt(t, valid(map[string]any{"scope": "orders:write"}), nil) }, http.StatusForbidden},
+		{"scope prefix", func() string { return signJwt(t, valid(map[string]any{"scope": "orders:reader"}), nil) }, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := opts.verify(tt.token())
+			if tt.code != 0 {
+				if err == nil || err.code != tt.code {
+					t.Fatalf("error = %v, want %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error = %s", err.message)
+			}
+			if claims["sub"] != "alice" {
+				t.Errorf("sub = %v", claims["sub"])
+			}
+		})
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	auth := &AuthOptions{Realm: "mock", BasicUsers: map[string]string{"a": "b"}, Jwt: &JwtOptions{Secret: testSecret}}
+
+	tests := []struct {
+		name string
+		err  *authError
+		want []string
+	}{
+		{"unauthorized", unauthorized("token expired"),
+			[]string{`Basic realm="mock"`, `Bearer realm="mock", error="invalid_token", error_description="token expired"`}},
+		{"forbidden", forbidden("claim scope not allowed"),
+			[]string{`Basic realm="mock"`, `Bearer realm="mock", error="insufficient_scope"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			auth.challenge(w, tt.err)
+			if got := w.Header().Values("WWW-Authenticate"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimValues(t *testing.T) {
+	auth := &AuthOptions{ClaimQuery: map[string]string{"owner": "sub", "tenant": "tid"}}
+
+	tests := []struct {
+		name   string
+		values url.Values
+		claims map[string]any
+		want   url.Values
+	}{
+		{"claims", url.Values{"status": {"open"}}, map[string]any{"sub": "alice", "tid": float64(7)},
+			url.Values{"status": {"open"}, "owner": {"alice"}, "tenant": {"7"}}},
+		{"query can't override a claim", url.Values{"owner": {"bob"}}, map[string]any{"sub": "alice", "tid": "t"},
+			url.Values{"owner": {"alice"}, "tenant": {"t"}}},
+		{"missing claim matches nothing", url.Values{}, map[string]any{"sub": "alice"},
+			url.Values{"owner": {"alice"}, "tenant": {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := auth.claimValues(tt.values, tt.claims); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("values = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	datum := map[string]any{"owner": "alice", "tenant": "t"}
+	route := Route{}
+	if got := route.matchQuery([]any{datum}, url.Values{"owner": {"alice"}, "tenant": {}}); len(got) != 0 {
+		t.Errorf("a missing claim matched %v", got)
+	}
+}
+
+func TestFillClaims(t *testing.T) {
+	claims := map[string]any{"sub": "alice", "roles": []any{"admin"}}
+	r := withClaims(httptest.NewRequest("GET", "/", nil), claims)
+
+	data := map[string]any{
+		"owner":    "{{claims.sub}}",
+		"greeting": "hi {{ claims.sub }}!",
+		"roles":    "{{claims.roles}}",
+		"missing":  "{{claims.nope}}",
+		"items":    []any{map[string]any{"by": "{{claims.sub}}"}, float64(1)},
+	}
+	want := map[string]any{
+		"owner":    "alice",
+		"greeting": "hi alice!",
+		"roles":    []any{"admin"},
+		"missing":  "",
+		"items":    []any{map[string]any{"by": "alice"}, float64(1)},
+	}
+	if got := fillClaims(r, data); !reflect.DeepEqual(got, want) {
+		t.Errorf("filled = %v, want %v", got, want)
+	}
+	if data["owner"] != "{{claims.sub}}" {
+		t.Error("the data is modified")
+	}
+
+	plain := httptest.NewRequest("GET", "/", nil)
+	if got := fillClaims(plain, data); !reflect.DeepEqual(got, data) {
+		t.Errorf("filled without claims = %v", got)
+	}
+}
@@ -0,0 +1,422 @@
+package conf
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	KEY_INCLUDE = "include"
+
+	// the prefix of the environment variables overriding the config, e.g. SMOCK_PORT
+	ENV_PREFIX = "SMOCK_"
+)
+
+const (
+	TOML_BARE tomlContext = iota
+	TOML_COMMENT
+	TOML_BASIC
+	TOML_ML_BASIC
+	TOML_LITERAL
+	TOML_ML_LITERAL
+)
+
+var (
+	overrides = &overrideList{}
+
+	// the top level properties that can be overridden by the environment variables and the -set flags
+	OVERRIDE_KEYS = []string{
+		KEY_HTTP_PORT, KEY_HTTP_ROOT, KEY_DYNAMIC_ROUTE,
+		KEY_CONSUL_API_BASE, KEY_CONSUL_SERVICE_NAME, KEY_CONSUL_SERVICE_HOST,
+		KEY_HEALTH_PATH, KEY_READY_PATH, KEY_METRICS_PATH, KEY_HEALTH_STATUS, KEY_H2C,
+		KEY_TLS_CERT, KEY_TLS_KEY, KEY_TLS_AUTO, KEY_TLS_HOSTS, KEY_TLS_CA_OUT, KEY_CLIENT_CA, KEY_CLIENT_AUTH,
+		KEY_OPENAPI, KEY_OPENAPI_VALIDATE,
+	}
+
+	// the override keys which are not strings
+	BOOL_OVERRIDE_KEYS = []string{KEY_DYNAMIC_ROUTE, KEY_H2C, KEY_TLS_AUTO, KEY_OPENAPI_VALIDATE}
+	LIST_OVERRIDE_KEYS = []string{KEY_TLS_HOSTS}
+
+	// ${VAR}, ${VAR:-default}, and $${ for a literal ${
+	envPattern = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+)
+
+type (
+	// tomlContext is where a variable is in the config, it decides how the value is put
+	tomlContext int
+
+	// overrideList is the repeatable -set key=value flag
+	overrideList struct {
+		values []string
+	}
+)
+
+func init() {
+	flag.Var(overrides, "set", "override a top level property of the http server configs, e.g. -set port=9090,\nor of one of them, e.g. -set a.http.server.conf:port=9090, repeatable")
+}
+
+func (list *overrideList) String() string {
+	return strings.Join(list.values, ",")
+}
+
+func (list *overrideList) Set(value string) error {
+	target, v, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expect key=value: %s", value)
+	}
+	_, key := overrideTarget(target)
+	if !slices.Contains(OVERRIDE_KEYS, key) {
+		return fmt.Errorf("unknown key: %s, one of %s", key, strings.Join(OVERRIDE_KEYS, ", "))
+	}
+	if _, err := overrideValue(key, v); err != nil {
+		return err
+	}
+	list.values = append(list.values, value)
+	return nil
+}
+
+// overrideTarget splits the target of a -set flag into the config file it's scoped to and the key,
+// e.g. a.http.server.conf:port, the file is empty if it's not scoped
+func overrideTarget(target string) (file string, key string) {
+	if i := strings.LastIndex(target, ":"); i >= 0 {
+		return target[:i], target[i+1:]
+	}
+	return "", target
+}
+
+// sameFile checks whether the paths are the same file
+func sameFile(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
+
+// checkOverrides checks the overrides against the config files, a scoped one must match a file,
+// and the port of several http servers can't be overridden as they would conflict
+func checkOverrides(files []string) error {
+	if _, ok := os.LookupEnv(ENV_PREFIX + strings.ToUpper(KEY_HTTP_PORT)); ok && len(files) > 1 {
+		return fmt.Errorf("%s%s overrides the port of %d http servers, use -set <file>:%s=<port> instead",
+			ENV_PREFIX, strings.ToUpper(KEY_HTTP_PORT), len(files), KEY_HTTP_PORT)
+	}
+
+	for _, kv := range overrides.values {
+		target, _, _ := strings.Cut(kv, "=")
+		file, key := overrideTarget(target)
+		if file == "" {
+			if key == KEY_HTTP_PORT && len(files) > 1 {
+				return fmt.Errorf("-set %s overrides the port of %d http servers, use -set <file>:%s=<port> instead", kv, len(files), KEY_HTTP_PORT)
+			}
+			continue
+		}
+		if !slices.ContainsFunc(files, func(f string) bool { return sameFile(f, file) }) {
+			return fmt.Errorf("-set %s: %s is not an http server config", kv, file)
+		}
+	}
+	return nil
+}
+
+// configOverrides returns the top level properties of the config file overridden by the environment variables
+// and the -set flags, the flags take precedence, and the ones scoped to the file over the others
+func configOverrides(configPath string) (map[string]any, error) {
+	result := make(map[string]any)
+	for _, key := range OVERRIDE_KEYS {
+		if value, ok := os.LookupEnv(ENV_PREFIX + strings.ToUpper(key)); ok {
+			v, err := overrideValue(key, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s%s: %w", ENV_PREFIX, strings.ToUpper(key), err)
+			}
+			result[key] = v
+		}
+	}
+
+	scoped := make(map[string]any)
+	for _, kv := range overrides.values {
+		target, value, _ := strings.Cut(kv, "=")
+		file, key := overrideTarget(target)
+		if file != "" && !sameFile(file, configPath) {
+			continue
+		}
+
+		v, err := overrideValue(key, value)
+		if err != nil {
+			return nil, err
+		}
+		if file != "" {
+			scoped[key] = v
+		} else {
+			result[key] = v
+		}
+	}
+	for key, v := range scoped {
+		result[key] = v
+	}
+	return result, nil
+}
+
+// overrideValue converts the value to the type of the key as toml decodes it, e.g. true, 8080,
+// and ["a", "b"] or a,b for a list, the others are strings as they are
+func overrideValue(key string, value string) (any, error) {
+	switch {
+	case key == KEY_HTTP_PORT:
+		port, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", key, value)
+		}
+		return port, nil
+	case slices.Contains(BOOL_OVERRIDE_KEYS, key):
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %s", key, value)
+		}
+		return b, nil
+	case slices.Contains(LIST_OVERRIDE_KEYS, key):
+		if strings.HasPrefix(strings.TrimSpace(value), "[") {
+			var m map[string]any
+			if _, err := toml.Decode("v = "+value, &m); err != nil {
+				return nil, fmt.Errorf("invalid %s: %s", key, value)
+			}
+			return m["v"], nil
+		}
+		list := make([]any, 0)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	}
+	return value, nil
+}
+
+// interpolate replaces the environment variables in the config, the default is used if the variable is unset or empty,
+// the values are escaped in the strings and must be single toml values out of them, the comments are kept as they are
+func interpolate(text string) (string, error) {
+	var b strings.Builder
+	context := TOML_BARE
+	for i := 0; i < len(text); {
+		rest := text[i:]
+
+		if context != TOML_COMMENT && rest[0] == '$' {
+			if loc := envPattern.FindStringSubmatchIndex(rest); loc != nil && loc[0] == 0 {
+				value, err := envValue(rest, loc, context)
+				if err != nil {
+					return "", err
+				}
+				b.WriteString(value)
+				i += loc[1]
+				continue
+			}
+		}
+
+		n := 1
+		switch context {
+		case TOML_BARE:
+			switch {
+			case rest[0] == '#':
+				context = TOML_COMMENT
+			case strings.HasPrefix(rest, `"""`):
+				context, n = TOML_ML_BASIC, 3
+			case rest[0] == '"':
+				context = TOML_BASIC
+			case strings.HasPrefix(rest, "'''"):
+				context, n = TOML_ML_LITERAL, 3
+			case rest[0] == '\'':
+				context = TOML_LITERAL
+			}
+		case TOML_COMMENT:
+			if rest[0] == '\n' {
+				context = TOML_BARE
+			}
+		case TOML_BASIC, TOML_ML_BASIC:
+			switch {
+			case rest[0] == '\\' && len(rest) > 1:
+				n = 2
+			case context == TOML_BASIC && (rest[0] == '"' || rest[0] == '\n'):
+				context = TOML_BARE
+			case context == TOML_ML_BASIC && strings.HasPrefix(rest, `"""`):
+				context, n = TOML_BARE, 3
+			}
+		case TOML_LITERAL:
+			if rest[0] == '\'' || rest[0] == '\n' {
+				context = TOML_BARE
+			}
+		case TOML_ML_LITERAL:
+			if strings.HasPrefix(rest, "'''") {
+				context, n = TOML_BARE, 3
+			}
+		}
+		b.WriteString(rest[:n])
+		i += n
+	}
+	return b.String(), nil
+}
+
+// envValue returns the replacement of the matched variable in the context,
+// the defaults are written by the config and taken as they are
+func envValue(rest string, loc []int, context tomlContext) (string, error) {
+	if rest[:loc[1]] == "$${" {
+		return "${", nil
+	}
+
+	name := rest[loc[2]:loc[3]]
+	value, ok := os.LookupEnv(name)
+	if !ok || (value == "" && loc[4] >= 0) {
+		if loc[6] >= 0 {
+			return rest[loc[6]:loc[7]], nil
+		}
+		return "", nil
+	}
+
+	switch context {
+	case TOML_BASIC, TOML_ML_BASIC:
+		return escapeToml(value), nil
+	case TOML_LITERAL:
+		if strings.ContainsAny(value, "'\n") {
+			return "", fmt.Errorf("${%s} can't be put in a literal string, use a quoted one", name)
+		}
+	case TOML_ML_LITERAL:
+		if strings.Contains(value, "'''") {
+			return "", fmt.Errorf("${%s} can't be put in a multi-line literal string, use a quoted one", name)
+		}
+	default:
+		// a number, a bool, or a list, but nothing more
+		var m map[string]any
+		if _, err := toml.Decode("v = "+value, &m); err != nil || strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("${%s} is not a toml value, put it in quotes if it's a string", name)
+		}
+	}
+	return value, nil
+}
+
+// escapeToml escapes the value for a basic string
+func escapeToml(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, "\\u%04X", r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	return b.String()
+}
+
+// decodeConfig decodes the config file after the interpolation
+func decodeConfig(file string) (map[string]any, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	text, err := interpolate(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var m map[string]any
+	if _, err := toml.Decode(text, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// loadConfig decodes the config file and merges the included ones into it,
+// the patterns of include are relative to the dir of the config file
+func loadConfig(file string) (map[string]any, error) {
+	m, err := decodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+
+	include, ok := m[KEY_INCLUDE]
+	if !ok {
+		return m, nil
+	}
+	delete(m, KEY_INCLUDE)
+
+	var patterns []any
+	switch v := include.(type) {
+	case string:
+		patterns = []any{v}
+	case []any:
+		patterns = v
+	default:
+		return nil, fmt.Errorf("invalid %s: %v", KEY_INCLUDE, include)
+	}
+
+	for _, p := range patterns {
+		pattern, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid %s: %v", KEY_INCLUDE, p)
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(file), pattern)
+		}
+
+		matched, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matched) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("included file not found: %s", pattern)
+		}
+		sort.Strings(matched)
+
+		for _, included := range matched {
+			im, err := decodeConfig(included)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", included, err)
+			}
+			if _, ok := im[KEY_INCLUDE]; ok {
+				return nil, fmt.Errorf("%s: nested %s is not supported", included, KEY_INCLUDE)
+			}
+			if err := mergeConfig(m, im, ""); err != nil {
+				return nil, fmt.Errorf("%s: %w", included, err)
+			}
+		}
+	}
+	return m, nil
+}
+
+// mergeConfig merges the tables of src into dst, e.g. the routes of a virtual host, the other keys must not be duplicated
+func mergeConfig(dst map[string]any, src map[string]any, prefix string) error {
+	for key, value := range src {
+		existing, ok := dst[key]
+		if !ok {
+			dst[key] = value
+			continue
+		}
+
+		dm, dok := existing.(map[string]any)
+		sm, sok := value.(map[string]any)
+		if !dok || !sok {
+			return fmt.Errorf("duplicate key: %s%s", prefix, key)
+		}
+		if err := mergeConfig(dm, sm, prefix+key+"."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
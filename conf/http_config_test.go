@@ -0,0 +1,128 @@
+package conf
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestInterpolate(t *testing.T) {
+	tests := []struct {
+		name   string
+		env    map[string]string
+		config string
+		want   map[string]any
+		fail   bool
+	}{
+		{
+			name:   "quote and newline in a string",
+			env:    map[string]string{"SMOCK_TEST_V": "a\"b\nc\\d"},
+			config: `v = "${SMOCK_TEST_V}"`,
+			want:   map[string]any{"v": "a\"b\nc\\d"},
+		},
+		{
+			name:   "injection in a string",
+			env:    map[string]string{"SMOCK_TEST_V": "x\"\n[evil]\nk = 1\n#"},
+			config: "v = \"${SMOCK_TEST_V}\"",
+			want:   map[string]any{"v": "x\"\n[evil]\nk = 1\n#"},
+		},
+		{
+			name:   "multi-line string",
+			env:    map[string]string{"SMOCK_TEST_V": `say """hi"""`},
+			config: "v = \"\"\"\n${SMOCK_TEST_V}\"\"\"",
+			want:   map[string]any{"v": `say """hi"""`},
+		},
+		{
+			name:   "bare number",
+			env:    map[string]string{"SMOCK_TEST_V": "9090"},
+			config: "port = ${SMOCK_TEST_V}",
+			want:   map[string]any{"port": int64(9090)},
+		},
+		{
+			name:   "bare list",
+			env:    map[string]string{"SMOCK_TEST_V": `["a", "b"]`},
+			config: "hosts = ${SMOCK_TEST_V}",
+			want:   map[string]any{"hosts": []any{"a", "b"}},
+		},
+		{
+			name:   "injection out of a string",
+			env:    map[string]string{"SMOCK_TEST_V": "1\n[evil]"},
+			config: "port = ${SMOCK_TEST_V}",
+			fail:   true,
+		},
+		{
+			name:   "default",
+			config: "port = ${SMOCK_TEST_UNSET:-8080}\nv = \"${SMOCK_TEST_UNSET:-a b}\"",
+			want:   map[string]any{"port": int64(8080), "v": "a b"},
+		},
+		{
+			name:   "default of an empty variable",
+			env:    map[string]string{"SMOCK_TEST_V": ""},
+			config: `v = "${SMOCK_TEST_V:-d}"`,
+			want:   map[string]any{"v": "d"},
+		},
+		{
+			name:   "unset without default",
+			config: `v = "${SMOCK_TEST_UNSET}"`,
+			want:   map[string]any{"v": ""},
+		},
+		{
+			name:   "escaped",
+			env:    map[string]string{"SMOCK_TEST_V": "x"},
+			config: `v = "$${SMOCK_TEST_V}"`,
+			want:   map[string]any{"v": "${SMOCK_TEST_V}"},
+		},
+		{
+			name:   "comment",
+			env:    map[string]string{"SMOCK_TEST_V": "1\n[evil]"},
+			config: "# port = ${SMOCK_TEST_V}\nv = 1 # ${SMOCK_TEST_V}",
+			want:   map[string]any{"v": int64(1)},
+		},
+		{
+			name:   "hash in a string",
+			env:    map[string]string{"SMOCK_TEST_V": "x"},
+			config: `v = "#${SMOCK_TEST_V}"`,
+			want:   map[string]any{"v": "#x"},
+		},
+		{
+			name:   "literal string",
+			env:    map[string]string{"SMOCK_TEST_V": `C:\dir`},
+			config: `v = '${SMOCK_TEST_V}'`,
+			want:   map[string]any{"v": `C:\dir`},
+		},
+		{
+			name:   "quote in a literal string",
+			env:    map[string]string{"SMOCK_TEST_V": "it's"},
+			config: `v = '${SMOCK_TEST_V}'`,
+			fail:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			text, err := interpolate(tt.config)
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("interpolated to %q, want an error", text)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var m map[string]any
+			if _, err := toml.Decode(text, &m); err != nil {
+				t.Fatalf("decode %q: %s", text, err.Error())
+			}
+			if !reflect.DeepEqual(m, tt.want) {
+				t.Errorf("got %#v, want %#v", m, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package conf
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zddava/gowrap/consul"
+	"github.com/zddava/gowrap/json"
+)
+
+const (
+	CONSUL_REGISTER_PATH    = "/v1/agent/service/register"
+	CONSUL_CHECK_INTERVAL   = "15s"
+	CONSUL_CHECK_DEREGISTER = "30s"
+	CONSUL_TIMEOUT          = 2 * time.Second
+)
+
+type (
+	// consulService is the registration with an https check, which the consul client lacks
+	consulService struct {
+		ID      string         `json:"ID"`
+		Name    string         `json:"Name"`
+		Address string         `json:"Address"`
+		Port    int            `json:"Port"`
+		Check   consulTlsCheck `json:"Check"`
+	}
+
+	consulTlsCheck struct {
+		DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+		HTTP                           string `json:"HTTP"`
+		Interval                       string `json:"Interval"`
+		// the certificate is usually self-signed, e.g. by tls_auto
+		TLSSkipVerify bool `json:"TLSSkipVerify"`
+	}
+)
+
+// checkConsul rejects the tls configs which the consul health check can't pass
+func (config *HttpServer) checkConsul() error {
+	if config.ConsulApiBase == "" || config.ConsulServiceName == "" || config.tlsConfig == nil {
+		return nil
+	}
+	if config.tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+		return fmt.Errorf("consul health check can't pass %s=%s, use %s", KEY_CLIENT_AUTH, CLIENT_AUTH_REQUIRE, CLIENT_AUTH_OPTIONAL)
+	}
+	return nil
+}
+
+// registerConsul registers the server to consul, with an https check if tls is enabled
+func (server *HttpServer) registerConsul(client *consul.ConsulClient, instanceId string, host string) error {
+	if server.tlsConfig == nil {
+		return client.Register(server.ConsulServiceName, instanceId, server.HealthPath, host, server.Port, nil, nil)
+	}
+
+	body, err := json.Marshal(consulService{
+		ID:      instanceId,
+		Name:    server.ConsulServiceName,
+		Address: host,
+		Port:    server.Port,
+		Check: consulTlsCheck{
+			DeregisterCriticalServiceAfter: CONSUL_CHECK_DEREGISTER,
+			HTTP:                           "https://" + host + ":" + strconv.Itoa(server.Port) + server.HealthPath,
+			Interval:                       CONSUL_CHECK_INTERVAL,
+			TLSSkipVerify:                  true,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, client.ApiServiceBase+CONSUL_REGISTER_PATH, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", MIME_TYPE_JSON)
+
+	resp, err := (&http.Client{Timeout: CONSUL_TIMEOUT}).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("consul register error: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package conf
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	KEY_CORS = "cors"
+)
+
+var (
+	DEFAULT_CORS_METHODS = []string{"GET", "POST", "PUT", "DELETE"}
+)
+
+type (
+	// CorsOptions describes the cross-origin requests allowed by a site or a route
+	CorsOptions struct {
+		// origins like https://app.example.com, wildcards are supported, e.g. * or https://*.example.com
+		AllowOrigins []string `toml:"allow_origins,omitempty"`
+		// the default is GET, POST, PUT, DELETE
+		AllowMethods []string `toml:"allow_methods,omitempty"`
+		// the default is the headers requested by the preflight
+		AllowHeaders     []string `toml:"allow_headers,omitempty"`
+		AllowCredentials bool     `toml:"allow_credentials,omitempty"`
+		// seconds the preflight can be cached, 0 means not sent
+		MaxAge        int64    `toml:"max_age,omitempty"`
+		ExposeHeaders []string `toml:"expose_headers,omitempty"`
+	}
+)
+
+// allowOrigin returns the value of Access-Control-Allow-Origin for the origin, empty if it's not allowed
+func (cors *CorsOptions) allowOrigin(origin string) string {
+	for _, pattern := range cors.AllowOrigins {
+		if pattern == "*" {
+			// the wildcard is not allowed with credentials
+			if cors.AllowCredentials {
+				return origin
+			}
+			return "*"
+		}
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); matched {
+			return origin
+		}
+	}
+	return ""
+}
+
+// resetCors removes the cors headers written before, e.g. by the options of the site
+func resetCors(w http.ResponseWriter) {
+	for name := range w.Header() {
+		if strings.HasPrefix(name, "Access-Control-") {
+			w.Header().Del(name)
+		}
+	}
+}
+
+// writeCors writes the cors headers of an actual request, returns false if the origin is not allowed
+func (cors *CorsOptions) writeCors(w http.ResponseWriter, r *http.Request) bool {
+	resetCors(w)
+
+	origin := r.Header.Get("Origin")
+	if origin == "" || cors == nil {
+		return origin == ""
+	}
+
+	header := w.Header()
+	if !slices.Contains(header.Values("Vary"), "Origin") {
+		header.Add("Vary", "Origin")
+	}
+
+	allowed := cors.allowOrigin(origin)
+	if allowed == "" {
+		return false
+	}
+
+	header.Set("Access-Control-Allow-Origin", allowed)
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(cors.ExposeHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(cors.ExposeHeaders, ", "))
+	}
+	return true
+}
+
+// servePreflight responds to the preflight request
+func (cors *CorsOptions) servePreflight(w http.ResponseWriter, r *http.Request) {
+	if !cors.writeCors(w, r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	header := w.Header()
+	header.Del("Access-Control-Expose-Headers")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+
+	methods := cors.AllowMethods
+	if len(methods) == 0 {
+		methods = DEFAULT_CORS_METHODS
+	}
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+	if len(cors.AllowHeaders) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(cors.AllowHeaders, ", "))
+	} else if requested := r.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		header.Set("Access-Control-Allow-Headers", requested)
+	}
+
+	if cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.FormatInt(cors.MaxAge, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isPreflight checks if the request is a cors preflight
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// cors returns the cors options of the route, the route's own ones take precedence
+func (route Route) cors(site *HttpServer) *CorsOptions {
+	if route.Cors != nil {
+		return route.Cors
+	}
+	return site.Cors
+}
+
+// preflightRoute returns the route the preflight asks for
+func (server *HttpServer) preflightRoute(r *http.Request) (Route, bool) {
+	actual := r.Clone(r.Context())
+	actual.Method = strings.ToUpper(r.Header.Get("Access-Control-Request-Method"))
+	route, _, ok := server.staticRouteMatch(actual)
+	return route, ok
+}
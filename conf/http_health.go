@@ -0,0 +1,88 @@
+package conf
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	HEALTH_STATUS_UP   = "UP"
+	HEALTH_STATUS_DOWN = "DOWN"
+)
+
+type (
+	HealthStatus struct {
+		Status string `json:"status"`
+		Ready  *bool  `json:"ready,omitempty"`
+	}
+)
+
+// serveHealth handles the health and readiness endpoints, returns false if the request is not one of them
+func (server *HttpServer) serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	var up bool
+	switch {
+	case server.HealthPath != "" && r.URL.Path == server.HealthPath:
+		up = !server.unhealthy.Load()
+	case server.ReadyPath != "" && r.URL.Path == server.ReadyPath:
+		up = !server.unhealthy.Load() && server.ready.Load()
+	default:
+		return false
+	}
+
+	if up {
+		writeJson(w, http.StatusOK, HealthStatus{Status: HEALTH_STATUS_UP})
+	} else {
+		writeJson(w, http.StatusServiceUnavailable, HealthStatus{Status: HEALTH_STATUS_DOWN})
+	}
+	return true
+}
+
+// serveHealthAdmin shows the health status, or flips it with status=UP|DOWN and ready=true|false
+// in the query or the json body
+func (server *HttpServer) serveHealthAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		var status HealthStatus
+		if bytes, err := io.ReadAll(r.Body); err == nil && len(bytes) > 0 {
+			if err := JsonResolver.Unmarshal(bytes, &status); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		if s := r.URL.Query().Get("status"); s != "" {
+			status.Status = s
+		}
+		if s := r.URL.Query().Get("ready"); s != "" {
+			ready := s == "true"
+			status.Ready = &ready
+		}
+
+		switch strings.ToUpper(status.Status) {
+		case HEALTH_STATUS_UP:
+			server.unhealthy.Store(false)
+		case HEALTH_STATUS_DOWN:
+			server.unhealthy.Store(true)
+		case "":
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if status.Ready != nil {
+			server.ready.Store(*status.Ready)
+		}
+
+		log.Printf("health status changed: %s, ready: %v", server.healthStatus().Status, server.ready.Load())
+	}
+
+	writeJson(w, http.StatusOK, server.healthStatus())
+}
+
+func (server *HttpServer) healthStatus() HealthStatus {
+	ready := server.ready.Load()
+	status := HealthStatus{Status: HEALTH_STATUS_UP, Ready: &ready}
+	if server.unhealthy.Load() {
+		status.Status = HEALTH_STATUS_DOWN
+	}
+	return status
+}
@@ -0,0 +1,387 @@
+package conf
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/zddava/goext/enum"
+	"github.com/zddava/gowrap/json"
+)
+
+type (
+	// Exchange is a recorded request and its response
+	Exchange struct {
+		Name        string
+		Method      string
+		Path        string
+		Query       url.Values
+		Status      int
+		ContentType string
+		Body        []byte
+	}
+
+	PostmanCollection struct {
+		Info PostmanInfo   `json:"info"`
+		Item []PostmanItem `json:"item"`
+	}
+
+	PostmanInfo struct {
+		Name string `json:"name"`
+	}
+
+	PostmanItem struct {
+		Name     string            `json:"name"`
+		Item     []PostmanItem     `json:"item,omitempty"`
+		Request  *PostmanRequest   `json:"request,omitempty"`
+		Response []PostmanResponse `json:"response,omitempty"`
+	}
+
+	PostmanRequest struct {
+		Method string `json:"method"`
+		// either a raw string or a PostmanUrl
+		Url any `json:"url"`
+	}
+
+	PostmanUrl struct {
+		Raw   string            `json:"raw"`
+		Path  []string          `json:"path,omitempty"`
+		Query []PostmanKeyValue `json:"query,omitempty"`
+	}
+
+	PostmanKeyValue struct {
+		Key      string `json:"key"`
+		Value    string `json:"value"`
+		Disabled bool   `json:"disabled,omitempty"`
+	}
+
+	PostmanResponse struct {
+		Name            string            `json:"name"`
+		OriginalRequest *PostmanRequest   `json:"originalRequest,omitempty"`
+		Code            int               `json:"code"`
+		Header          []PostmanKeyValue `json:"header,omitempty"`
+		Body            string            `json:"body"`
+	}
+
+	Har struct {
+		Log HarLog `json:"log"`
+	}
+
+	HarLog struct {
+		Entries []HarEntry `json:"entries"`
+	}
+
+	HarEntry struct {
+		Request  HarRequest  `json:"request"`
+		Response HarResponse `json:"response"`
+	}
+
+	HarRequest struct {
+		Method string `json:"method"`
+		Url    string `json:"url"`
+	}
+
+	HarResponse struct {
+		Status  int        `json:"status"`
+		Content HarContent `json:"content"`
+	}
+
+	HarContent struct {
+		MimeType string `json:"mimeType"`
+		Text     string `json:"text"`
+		Encoding string `json:"encoding,omitempty"`
+	}
+)
+
+var (
+	postmanVariable = regexp.MustCompile(`\{\{[^}]*\}\}`)
+)
+
+// LoadPostman reads the exchanges of a postman collection, one for every saved example response,
+// or one without response for the requests which have no example
+func LoadPostman(file string) ([]Exchange, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var collection PostmanCollection
+	if err := json.Unmarshal(data, &collection); err != nil {
+		return nil, err
+	}
+
+	exchanges := make([]Exchange, 0)
+	var walk func(items []PostmanItem)
+	walk = func(items []PostmanItem) {
+		for _, item := range items {
+			walk(item.Item)
+			if item.Request == nil {
+				continue
+			}
+
+			ex := item.Request.exchange()
+			ex.Name = item.Name
+			if len(item.Response) == 0 {
+				exchanges = append(exchanges, ex)
+				continue
+			}
+
+			for _, resp := range item.Response {
+				rex := ex
+				if resp.OriginalRequest != nil {
+					rex = resp.OriginalRequest.exchange()
+					rex.Name = item.Name
+				}
+				rex.Status = resp.Code
+				rex.Body = []byte(resp.Body)
+				for _, h := range resp.Header {
+					if strings.EqualFold(h.Key, "Content-Type") {
+						rex.ContentType = h.Value
+					}
+				}
+				exchanges = append(exchanges, rex)
+			}
+		}
+	}
+	walk(collection.Item)
+
+	return exchanges, nil
+}
+
+func (req *PostmanRequest) exchange() Exchange {
+	ex := Exchange{Method: strings.ToUpper(req.Method), Query: make(url.Values)}
+
+	var pu PostmanUrl
+	switch u := req.Url.(type) {
+	case string:
+		pu.Raw = u
+	case map[string]any:
+		json.Convert(&pu, u)
+	}
+
+	if len(pu.Path) > 0 {
+		ex.Path = postmanPath(pu.Path)
+		for _, kv := range pu.Query {
+			if !kv.Disabled {
+				ex.Query.Add(kv.Key, kv.Value)
+			}
+		}
+	} else {
+		raw := postmanVariable.ReplaceAllString(pu.Raw, "")
+		if !strings.Contains(raw, "://") {
+			raw = "http://localhost" + "/" + strings.TrimPrefix(raw, "/")
+		}
+		if u, err := url.Parse(raw); err == nil {
+			ex.Path = postmanPath(strings.Split(strings.TrimPrefix(u.Path, "/"), "/"))
+			ex.Query = u.Query()
+		}
+	}
+
+	if ex.Path == "" {
+		ex.Path = "/"
+	}
+	return ex
+}
+
+// postmanPath joins the path segments, the path variables like :id become templates like {id}
+func postmanPath(segments []string) string {
+	converted := make([]string, 0, len(segments))
+	for _, segment := range segments {
+		if name, ok := strings.CutPrefix(segment, ":"); ok && name != "" {
+			segment = "{" + name + "}"
+		}
+		converted = append(converted, segment)
+	}
+	return "/" + strings.Join(converted, "/")
+}
+
+// LoadHar reads the exchanges of a har log
+func LoadHar(file string) ([]Exchange, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var har Har
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, err
+	}
+
+	exchanges := make([]Exchange, 0, len(har.Log.Entries))
+	for _, entry := range har.Log.Entries {
+		u, err := url.Parse(entry.Request.Url)
+		if err != nil {
+			log.Printf("skip har entry: %s", err.Error())
+			continue
+		}
+
+		ex := Exchange{
+			Method:      strings.ToUpper(entry.Request.Method),
+			Path:        u.Path,
+			Query:       u.Query(),
+			Status:      entry.Response.Status,
+			ContentType: entry.Response.Content.MimeType,
+			Body:        []byte(entry.Response.Content.Text),
+		}
+		if entry.Response.Content.Encoding == "base64" {
+			if ex.Body, err = base64.StdEncoding.DecodeString(entry.Response.Content.Text); err != nil {
+				log.Printf("skip har entry: %s", err.Error())
+				continue
+			}
+		}
+		if ex.Path == "" {
+			ex.Path = "/"
+		}
+
+		exchanges = append(exchanges, ex)
+	}
+
+	return exchanges, nil
+}
+
+// decodeBody decodes the response body of the exchange with the resolver of its content type
+func (ex Exchange) decodeBody() (body any, ok bool) {
+	if len(ex.Body) == 0 {
+		return nil, false
+	}
+	if ex.Status != 0 && (ex.Status < 200 || ex.Status >= 300) {
+		return nil, false
+	}
+
+	mimeType := strings.TrimSpace(strings.Split(strings.ToLower(ex.ContentType), ";")[0])
+	resolver := HttpFileResolver(JsonResolver)
+	if ft, found := MimeTypeMap[mimeType]; found {
+		resolver = ft.Resolver
+	} else if mimeType != "" && !strings.HasSuffix(mimeType, "json") {
+		return nil, false
+	}
+
+	if err := resolver.Unmarshal(ex.Body, &body); err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// ImportExchanges writes the route sections merged from the exchanges to out, and the data files under root,
+// exchanges with the same path and method are merged into one route
+func ImportExchanges(exchanges []Exchange, root string, out io.Writer) error {
+	keys := make([]string, 0)
+	grouped := make(map[string][]Exchange)
+	for _, ex := range exchanges {
+		if enum.ParseEnum[HTTP_METHOD](ex.Method) == nil {
+			log.Printf("skip unsupported method: %s %s", ex.Method, ex.Path)
+			continue
+		}
+
+		key := ex.Path + "_" + ex.Method
+		if _, ok := grouped[key]; !ok {
+			keys = append(keys, key)
+		}
+		grouped[key] = append(grouped[key], ex)
+	}
+	sort.Strings(keys)
+
+	rim := make(RouteInfoMap)
+	names := make(map[string]bool)
+	models := make(map[string]*HttpFileModel)
+	resolvers := make(map[string]HttpFileResolver)
+	for _, key := range keys {
+		group := grouped[key]
+		ri := RouteInfo{Path: group[0].Path, Method: group[0].Method}
+
+		_, route, err := ri.resolve(root)
+		if err != nil {
+			// e.g. a post to /login.do, the others are still imported
+			log.Printf("skip %s %s: %s", ri.Method, ri.Path, err.Error())
+			continue
+		}
+		if _, ok := models[route.File]; !ok {
+			models[route.File] = &HttpFileModel{}
+			resolvers[route.File] = route.Resolver
+		}
+		mergeExchanges(&ri, models[route.File], group)
+
+		name := strings.Trim(nameSanitizer.ReplaceAllString(group[0].Name, "_"), "_")
+		if name == "" {
+			name = strings.Trim(nameSanitizer.ReplaceAllString(strings.ToLower(ri.Method)+"_"+ri.Path, "_"), "_")
+		}
+		for base, i := name, 2; names[name]; i++ {
+			name = base + "_" + fmt.Sprint(i)
+		}
+		names[name] = true
+		rim[name] = ri
+	}
+
+	if err := writeModels(models, resolvers); err != nil {
+		return err
+	}
+
+	return toml.NewEncoder(out).Encode(rim)
+}
+
+// mergeExchanges puts the response bodies of the exchanges of one route into the data file model
+func mergeExchanges(ri *RouteInfo, model *HttpFileModel, group []Exchange) {
+	objects := make([]map[string]any, 0)
+	lists := false
+	queried := strings.Contains(ri.Path, "{")
+	for _, ex := range group {
+		body, ok := ex.decodeBody()
+		if !ok {
+			continue
+		}
+		if len(ex.Query) > 0 {
+			queried = true
+		}
+
+		switch val := body.(type) {
+		case []any:
+			lists = true
+			for _, item := range val {
+				model.Data = appendDistinct(model.Data, item)
+			}
+		case map[string]any:
+			objects = append(objects, val)
+		}
+	}
+
+	if len(objects) == 0 {
+		return
+	}
+
+	switch ri.Method {
+	case HTTP_METHOD_GET.Code:
+		if !lists && !queried && len(objects) == 1 {
+			ri.Single = true
+			model.Datum = objects[0]
+			return
+		}
+		if !lists {
+			ri.UniqueNotList = true
+		}
+		for _, obj := range objects {
+			model.Data = appendDistinct(model.Data, obj)
+		}
+	case HTTP_METHOD_DELETE.Code:
+		model.DelResponse = objects[len(objects)-1]
+	default:
+		model.PostResponse = objects[len(objects)-1]
+	}
+}
+
+// appendDistinct appends the item if the list does not contain an equal one
+func appendDistinct(list []any, item any) []any {
+	encoded := json.MarshalToStringIgnoreError(item)
+	for _, existing := range list {
+		if json.MarshalToStringIgnoreError(existing) == encoded {
+			return list
+		}
+	}
+	return append(list, item)
+}
@@ -0,0 +1,181 @@
+package conf
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	KEY_LOG = "log"
+
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+
+	DEFAULT_LOG_BODY_LIMIT = 4096
+
+	LOG_REDACTED = "[REDACTED]"
+)
+
+var (
+	logFormat    = flag.String("log-format", "", "log format, text or json, overrides the conf")
+	logLevel     = flag.String("log-level", "", "log level, debug, info, warn or error, overrides the conf")
+	logBody      = flag.Bool("log-body", false, "log the request and response bodies")
+	logBodyLimit = flag.Int("log-body-limit", 0, "max bytes of the logged bodies, overrides the conf")
+	logHeaders   = flag.Bool("log-headers", false, "log the request headers")
+
+	// the headers always redacted, the configured ones are added to them
+	DEFAULT_REDACT_HEADERS = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-API-Key"}
+)
+
+type (
+	// LogOptions describes the request log
+	LogOptions struct {
+		// text(default) or json
+		Format string `toml:"format,omitempty"`
+		// debug, info(default), warn or error, 4xx responses are logged as warn and 5xx as error
+		Level string `toml:"level,omitempty"`
+		// log the request and response bodies up to body_limit bytes
+		Body      bool `toml:"body,omitempty"`
+		BodyLimit int  `toml:"body_limit,omitempty"`
+		// log the request headers, the redacted ones are replaced
+		Headers       bool     `toml:"headers,omitempty"`
+		RedactHeaders []string `toml:"redact_headers,omitempty"`
+
+		redact []string
+	}
+
+	// captureReader keeps what the handler reads from the request body
+	captureReader struct {
+		io.ReadCloser
+		body  *bytes.Buffer
+		limit int
+	}
+)
+
+func (reader *captureReader) Read(p []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(p)
+	if remaining := reader.limit - reader.body.Len(); remaining > 0 && n > 0 {
+		reader.body.Write(p[:min(n, remaining)])
+	}
+	return n, err
+}
+
+// newLogger applies the flags to the options and builds the logger of the server
+func (opts *LogOptions) newLogger() (*slog.Logger, error) {
+	if *logFormat != "" {
+		opts.Format = *logFormat
+	}
+	if *logLevel != "" {
+		opts.Level = *logLevel
+	}
+	if *logBody {
+		opts.Body = true
+	}
+	if *logBodyLimit > 0 {
+		opts.BodyLimit = *logBodyLimit
+	}
+	if *logHeaders {
+		opts.Headers = true
+	}
+	if opts.BodyLimit <= 0 {
+		opts.BodyLimit = DEFAULT_LOG_BODY_LIMIT
+	}
+	opts.redact = append(append([]string{}, DEFAULT_REDACT_HEADERS...), opts.RedactHeaders...)
+	for i, name := range opts.redact {
+		opts.redact[i] = http.CanonicalHeaderKey(name)
+	}
+
+	var level slog.Level
+	if opts.Level != "" {
+		if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+			return nil, fmt.Errorf("unknown log level: %s", opts.Level)
+		}
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(opts.Format) {
+	case "", LOG_FORMAT_TEXT:
+		return slog.New(slog.NewTextHandler(os.Stderr, handlerOpts)), nil
+	case LOG_FORMAT_JSON:
+		return slog.New(slog.NewJSONHandler(os.Stderr, handlerOpts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format: %s", opts.Format)
+}
+
+// capture starts capturing the bodies of the request and the response if it's enabled
+func (opts *LogOptions) capture(rec *responseRecorder, r *http.Request) *captureReader {
+	if !opts.Body {
+		return nil
+	}
+
+	rec.body, rec.limit = new(bytes.Buffer), opts.BodyLimit
+	reader := &captureReader{ReadCloser: r.Body, body: new(bytes.Buffer), limit: opts.BodyLimit}
+	r.Body = reader
+	return reader
+}
+
+// headers returns the request headers with the sensitive ones redacted
+func (opts *LogOptions) headers(header http.Header) slog.Attr {
+	attrs := make([]any, 0, len(header))
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		if slices.Contains(opts.redact, name) {
+			value = LOG_REDACTED
+		}
+		attrs = append(attrs, slog.String(name, value))
+	}
+	return slog.Group("headers", attrs...)
+}
+
+// logRequest logs the request when it's served
+func (server *HttpServer) logRequest(rec *responseRecorder, r *http.Request, reader *captureReader, duration time.Duration) {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	} else if status >= http.StatusBadRequest {
+		level = slog.LevelWarn
+	}
+	if !server.logger.Enabled(r.Context(), level) {
+		return
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", r.Method),
+		slog.String("uri", r.RequestURI),
+		slog.String("host", r.Host),
+		slog.String("remote", r.RemoteAddr),
+		slog.String("route", rec.labels.route),
+		slog.String("file", rec.file),
+		slog.Int("status", status),
+		slog.Float64("duration_ms", float64(duration.Microseconds())/1000),
+		slog.Int64("bytes", rec.bytes),
+	}
+	if subject := clientSubject(r); subject != nil {
+		attrs = append(attrs, slog.String("client", subject.String()))
+	}
+	if rec.traceId != "" {
+		attrs = append(attrs, slog.String("trace_id", rec.traceId))
+	}
+	if server.Log.Headers {
+		attrs = append(attrs, server.Log.headers(r.Header))
+	}
+	if reader != nil {
+		attrs = append(attrs, slog.String("request_body", reader.body.String()), slog.String("response_body", rec.body.String()))
+	}
+
+	server.logger.LogAttrs(r.Context(), level, "request", attrs...)
+}
@@ -0,0 +1,307 @@
+package conf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KEY_METRICS_PATH = "metrics_path"
+
+	DEFAULT_METRICS_PATH = "/metrics"
+
+	MIME_TYPE_PROMETHEUS = "text/plain; version=0.0.4; charset=utf-8"
+
+	FILE_OP_READ  = "read"
+	FILE_OP_WRITE = "write"
+
+	// the route label of the dynamic route, the paths are unbounded
+	METRICS_ROUTE_DYNAMIC = "dynamic"
+)
+
+var (
+	// the default buckets of the prometheus clients, in seconds
+	METRICS_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+	metrics = &metricsRegistry{
+		requests:   make(map[requestLabels]*histogram),
+		fileErrors: make(map[fileLabels]uint64),
+		fileItems:  make(map[string]int),
+	}
+)
+
+type (
+	// metricsRegistry keeps the metrics of every server in the process, each server exposes its own
+	metricsRegistry struct {
+		mutex      sync.Mutex
+		requests   map[requestLabels]*histogram
+		fileErrors map[fileLabels]uint64
+		fileItems  map[string]int
+	}
+
+	requestLabels struct {
+		// the port of the server
+		port   int
+		route  string
+		action string
+		status int
+		format string
+	}
+
+	fileLabels struct {
+		file string
+		op   string
+	}
+
+	histogram struct {
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+
+	// responseRecorder records the response and the route that served it, for the metrics and the log
+	responseRecorder struct {
+		http.ResponseWriter
+		status int
+		bytes  int64
+		labels requestLabels
+		file   string
+		// the trace id of the server span, empty if it's not traced
+		traceId string
+		// the captured body, nil if it's not captured
+		body  *bytes.Buffer
+		limit int
+	}
+)
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.body != nil && rec.body.Len() < rec.limit {
+		rec.body.Write(b[:min(len(b), rec.limit-rec.body.Len())])
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush keeps the streaming routes working
+func (rec *responseRecorder) Flush() {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack keeps the websocket routes working
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// record labels the request with the route that serves it
+func (rec *responseRecorder) record(route Route) {
+	rec.labels.route = route.Path + "_"
+	if route.dynamic {
+		rec.labels.route = METRICS_ROUTE_DYNAMIC + "_"
+	}
+	if route.Method != nil {
+		rec.labels.route += route.Method.Code
+	}
+	if route.Action != nil {
+		rec.labels.action = route.Action.Name
+	}
+	rec.labels.format = route.format()
+	rec.file = route.File
+}
+
+// format returns the name of the data file format of the route
+func (route Route) format() string {
+	if route.Raw {
+		return FORMAT_RAW
+	}
+	for _, ft := range FileTypes {
+		if ft.Resolver == route.Resolver {
+			return ft.FileExts[0]
+		}
+	}
+	return ""
+}
+
+func (registry *metricsRegistry) observe(rec *responseRecorder, duration time.Duration) {
+	labels := rec.labels
+	labels.status = rec.status
+	if labels.status == 0 {
+		labels.status = http.StatusOK
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	h, ok := registry.requests[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(METRICS_BUCKETS))}
+		registry.requests[labels] = h
+	}
+
+	seconds := duration.Seconds()
+	for i, bound := range METRICS_BUCKETS {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (registry *metricsRegistry) fileError(file string, op string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.fileErrors[fileLabels{file: file, op: op}]++
+}
+
+func (registry *metricsRegistry) items(file string, count int) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.fileItems[file] = count
+}
+
+// escapeLabel escapes the label value as the text format requires
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// write writes the metrics of the server in the prometheus text format
+func (registry *metricsRegistry) write(b *strings.Builder, server *HttpServer) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	requests := make([]requestLabels, 0, len(registry.requests))
+	for labels := range registry.requests {
+		if labels.port == server.Port {
+			requests = append(requests, labels)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return fmt.Sprint(requests[i]) < fmt.Sprint(requests[j])
+	})
+
+	b.WriteString("# HELP smock_http_requests_total Requests served by smock.\n")
+	b.WriteString("# TYPE smock_http_requests_total counter\n")
+	for _, labels := range requests {
+		fmt.Fprintf(b, "smock_http_requests_total{%s} %d\n", labels.String(), registry.requests[labels].count)
+	}
+
+	b.WriteString("# HELP smock_http_request_duration_seconds Latency of the requests served by smock.\n")
+	b.WriteString("# TYPE smock_http_request_duration_seconds histogram\n")
+	for _, labels := range requests {
+		h, l := registry.requests[labels], labels.String()
+		for i, bound := range METRICS_BUCKETS {
+			fmt.Fprintf(b, "smock_http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", l, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(b, "smock_http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, h.count)
+		fmt.Fprintf(b, "smock_http_request_duration_seconds_sum{%s} %s\n", l, formatFloat(h.sum))
+		fmt.Fprintf(b, "smock_http_request_duration_seconds_count{%s} %d\n", l, h.count)
+	}
+
+	errs := make([]fileLabels, 0, len(registry.fileErrors))
+	for labels := range registry.fileErrors {
+		if server.ownsFile(labels.file) {
+			errs = append(errs, labels)
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].file < errs[j].file || (errs[i].file == errs[j].file && errs[i].op < errs[j].op)
+	})
+
+	b.WriteString("# HELP smock_data_file_errors_total Errors reading or writing the data files.\n")
+	b.WriteString("# TYPE smock_data_file_errors_total counter\n")
+	for _, labels := range errs {
+		fmt.Fprintf(b, "smock_data_file_errors_total{file=\"%s\",op=\"%s\"} %d\n", escapeLabel(labels.file), labels.op, registry.fileErrors[labels])
+	}
+
+	files := make([]string, 0, len(registry.fileItems))
+	for file := range registry.fileItems {
+		if server.ownsFile(file) {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	b.WriteString("# HELP smock_data_file_items Items in the data of the data files, as last read or written.\n")
+	b.WriteString("# TYPE smock_data_file_items gauge\n")
+	for _, file := range files {
+		fmt.Fprintf(b, "smock_data_file_items{file=\"%s\"} %d\n", escapeLabel(file), registry.fileItems[file])
+	}
+}
+
+func (labels requestLabels) String() string {
+	return fmt.Sprintf(`port="%d",route="%s",action="%s",status="%d",format="%s"`,
+		labels.port, escapeLabel(labels.route), escapeLabel(labels.action), labels.status, escapeLabel(labels.format))
+}
+
+// ownsFile checks whether the data file is one of the static routes or in a db root of the server
+func (server *HttpServer) ownsFile(file string) bool {
+	_, sites := server.sites()
+	for _, site := range sites {
+		if rel, err := filepath.Rel(site.DBRoot, file); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+		for _, route := range site.StaticRoutes {
+			if route.File == file {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveMetrics serves the metrics, returns false if the request is not for them
+func (server *HttpServer) serveMetrics(w http.ResponseWriter, r *http.Request) bool {
+	if server.MetricsPath == "" || r.URL.Path != server.MetricsPath {
+		return false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return true
+	}
+
+	var b strings.Builder
+	metrics.write(&b, server)
+
+	w.Header().Set("Content-Type", MIME_TYPE_PROMETHEUS)
+	w.Write([]byte(b.String()))
+	return true
+}
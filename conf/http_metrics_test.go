@@ -0,0 +1,110 @@
+package conf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	root := t.TempDir()
+	registry := &metricsRegistry{
+		requests:   make(map[requestLabels]*histogram),
+		fileErrors: make(map[fileLabels]uint64),
+		fileItems:  make(map[string]int),
+	}
+
+	labels := requestLabels{port: 9000, route: "/users_GET", format: "json"}
+	for _, d := range []time.Duration{3 * time.Millisecond, 200 * time.Millisecond, 20 * time.Second} {
+		registry.observe(&responseRecorder{labels: labels}, d)
+	}
+	registry.observe(&responseRecorder{labels: requestLabels{port: 9001, route: "/other_GET"}}, time.Millisecond)
+	registry.fileError(filepath.Join(root, "users.json"), FILE_OP_WRITE)
+	registry.fileError(filepath.Join(t.TempDir(), "other.json"), FILE_OP_READ)
+	registry.items(filepath.Join(root, "users.json"), 3)
+
+	var b strings.Builder
+	registry.write(&b, &HttpServer{Port: 9000, DBRoot: root})
+	text := b.String()
+
+	l := `port="9000",route="/users_GET",action="",status="200",format="json"`
+	tests := []struct {
+		name string
+		line string
+		want bool
+	}{
+		{"count", `smock_http_requests_total{` + l + `} 3`, true},
+		{"first bucket", `smock_http_request_duration_seconds_bucket{` + l + `,le="0.005"} 1`, true},
+		{"middle bucket", `smock_http_request_duration_seconds_bucket{` + l + `,le="0.25"} 2`, true},
+		{"last bucket", `smock_http_request_duration_seconds_bucket{` + l + `,le="10"} 2`, true},
+		{"inf bucket", `smock_http_request_duration_seconds_bucket{` + l + `,le="+Inf"} 3`, true},
+		{"histogram count", `smock_http_request_duration_seconds_count{` + l + `} 3`, true},
+		{"file errors", `smock_data_file_errors_total{file="` + filepath.Join(root, "users.json") + `",op="write"} 1`, true},
+		{"file items", `smock_data_file_items{file="` + filepath.Join(root, "users.json") + `"} 3`, true},
+		{"other server", `/other_GET`, false},
+		{"other file", `other.json`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Contains(text, tt.line); got != tt.want {
+				t.Errorf("contains %q = %v, want %v\n%s", tt.line, got, tt.want, text)
+			}
+		})
+	}
+}
+
+func TestMetricsEscapeLabel(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{`/a`, `/a`},
+		{`a"b`, `a\"b`},
+		{`a\b`, `a\\b`},
+		{"a\nb", `a\nb`},
+	}
+
+	for _, tt := range tests {
+		if got := escapeLabel(tt.value); got != tt.want {
+			t.Errorf("escapeLabel(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	server := &HttpServer{Port: 9002, MetricsPath: DEFAULT_METRICS_PATH}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		served bool
+		code   int
+	}{
+		{"get", "GET", DEFAULT_METRICS_PATH, true, http.StatusOK},
+		{"post", "POST", DEFAULT_METRICS_PATH, true, http.StatusMethodNotAllowed},
+		{"other path", "GET", "/users", false, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if served := server.serveMetrics(w, httptest.NewRequest(tt.method, tt.path, nil)); served != tt.served {
+				t.Fatalf("served = %v, want %v", served, tt.served)
+			}
+			if !tt.served {
+				return
+			}
+			if w.Code != tt.code {
+				t.Errorf("code = %d, want %d", w.Code, tt.code)
+			}
+			if tt.code == http.StatusOK && w.Header().Get("Content-Type") != MIME_TYPE_PROMETHEUS {
+				t.Errorf("Content-Type = %q", w.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package conf
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type (
+	// mediaRange is one entry of the Accept header
+	mediaRange struct {
+		mimeType string
+		q        float64
+	}
+)
+
+// parseAccept parses the Accept header, the entries are sorted by q, the more specific first
+func parseAccept(accept string) []mediaRange {
+	ranges := make([]mediaRange, 0)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mimeType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mimeType == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(value, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		ranges = append(ranges, mediaRange{mimeType: mimeType, q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+		return strings.Count(ranges[i].mimeType, "*") < strings.Count(ranges[j].mimeType, "*")
+	})
+	return ranges
+}
+
+// negotiate picks the resolver of the response by the Accept header,
+// the resolver of the data file is preferred when it's acceptable
+func negotiate(accept string, preferred HttpFileResolver) (HttpFileResolver, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return preferred, true
+	}
+
+	candidates := []HttpFileResolver{preferred}
+	for _, ft := range FileTypes {
+		if ft.Resolver != preferred {
+			candidates = append(candidates, ft.Resolver)
+		}
+	}
+
+	for _, mr := range parseAccept(accept) {
+		if mr.q <= 0 {
+			continue
+		}
+
+		if ft, ok := MimeTypeMap[mr.mimeType]; ok {
+			return ft.Resolver, true
+		}
+
+		prefix, wildcard := strings.CutSuffix(mr.mimeType, "*")
+		if !wildcard {
+			continue
+		}
+		if prefix == "*/" {
+			prefix = ""
+		}
+		for _, candidate := range candidates {
+			if strings.HasPrefix(candidate.ContentType(), prefix) {
+				return candidate, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// locateFile finds the data file of the path whatever extension it uses
+func locateFile(base string) (string, HttpFileType, bool) {
+	for _, ft := range FileTypes {
+		for _, ext := range ft.FileExts {
+			file := base + "." + ext
+			if info, err := os.Stat(file); err == nil && !info.IsDir() {
+				return file, ft, true
+			}
+		}
+	}
+	return "", HttpFileType{}, false
+}
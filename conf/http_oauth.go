@@ -0,0 +1,624 @@
+package conf
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zddava/gowrap/json"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	KEY_OAUTH = "oauth"
+
+	OAUTH_PATH_TOKEN     = "/token"
+	OAUTH_PATH_AUTHORIZE = "/authorize"
+	OAUTH_PATH_JWKS      = "/jwks"
+	OAUTH_PATH_USERINFO  = "/userinfo"
+	OAUTH_PATH_DISCOVERY = "/.well-known/openid-configuration"
+
+	// "/" puts the endpoints at the root
+	DEFAULT_OAUTH_PATH_PREFIX = "/oauth"
+
+	GRANT_CLIENT_CREDENTIALS  = "client_credentials"
+	GRANT_PASSWORD            = "password"
+	GRANT_REFRESH_TOKEN       = "refresh_token"
+	GRANT_AUTHORIZATION_CODE  = "authorization_code"
+	DEFAULT_ACCESS_TOKEN_TTL  = 3600
+	DEFAULT_REFRESH_TOKEN_TTL = 86400
+	OAUTH_CODE_TTL            = 5 * time.Minute
+	OAUTH_KEY_ID              = "smock"
+	OAUTH_SCOPE_OPENID        = "openid"
+	DEFAULT_OAUTH_USER        = "user"
+)
+
+type (
+	// OAuthOptions describes the mock authorization server, the clients and users are not checked if there is none
+	OAuthOptions struct {
+		// the default is the scheme and host of the request with path_prefix
+		Issuer string `toml:"issuer,omitempty"`
+		// the default is /oauth
+		PathPrefix string `toml:"path_prefix,omitempty"`
+		// the aud of the access tokens, the default is the client id
+		Audience string                  `toml:"audience,omitempty"`
+		Clients  map[string]*OAuthClient `toml:"clients,omitempty"`
+		Users    map[string]*OAuthUser   `toml:"users,omitempty"`
+		// seconds
+		AccessTokenTtl  int64 `toml:"access_token_ttl,omitempty"`
+		RefreshTokenTtl int64 `toml:"refresh_token_ttl,omitempty"`
+		// extra claims of every token
+		Claims map[string]any `toml:"claims,omitempty"`
+		// the tokens are signed with HS256 by the secret if it's set, otherwise RS256 by a generated key
+		Secret string `toml:"secret,omitempty"`
+
+		key    *rsa.PrivateKey
+		mutex  sync.Mutex
+		codes  map[string]*oauthGrant
+		tokens map[string]*oauthGrant
+	}
+
+	OAuthClient struct {
+		Secret       string         `toml:"secret,omitempty"`
+		Scopes       []string       `toml:"scopes,omitempty"`
+		RedirectUris []string       `toml:"redirect_uris,omitempty"`
+		Claims       map[string]any `toml:"claims,omitempty"`
+	}
+
+	OAuthUser struct {
+		Password string         `toml:"password,omitempty"`
+		Claims   map[string]any `toml:"claims,omitempty"`
+	}
+
+	// oauthGrant is what an authorization code or a refresh token stands for
+	oauthGrant struct {
+		clientId      string
+		subject       string
+		scope         string
+		nonce         string
+		redirectUri   string
+		codeChallenge string
+		expires       time.Time
+		// the client credentials grant has no refresh token
+		refreshable bool
+	}
+
+	// oauthError is responded as defined by RFC 6749
+	oauthError struct {
+		code        int
+		Error       string `json:"error"`
+		Description string `json:"error_description,omitempty"`
+	}
+)
+
+func newOAuthError(code int, err string, description string) *oauthError {
+	return &oauthError{code: code, Error: err, Description: description}
+}
+
+// compile generates the signing key, which the dry run skips
+func (oauth *OAuthOptions) compile(dryRun bool) (err error) {
+	if oauth.PathPrefix == "" {
+		oauth.PathPrefix = DEFAULT_OAUTH_PATH_PREFIX
+	}
+	oauth.PathPrefix = strings.TrimSuffix(oauth.PathPrefix, "/")
+	oauth.codes = make(map[string]*oauthGrant)
+	oauth.tokens = make(map[string]*oauthGrant)
+	if oauth.AccessTokenTtl <= 0 {
+		oauth.AccessTokenTtl = DEFAULT_ACCESS_TOKEN_TTL
+	}
+	if oauth.RefreshTokenTtl <= 0 {
+		oauth.RefreshTokenTtl = DEFAULT_REFRESH_TOKEN_TTL
+	}
+
+	if oauth.Secret == "" && !dryRun {
+		oauth.key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return
+}
+
+// linkOAuth lets the jwt options with oauth=true verify the tokens issued by the server
+func (server *HttpServer) linkOAuth() error {
+	sites := []*HttpServer{server}
+	for _, vhost := range server.Hosts {
+		sites = append(sites, vhost)
+	}
+
+	if server.OAuth != nil {
+		endpoints := []string{OAUTH_PATH_DISCOVERY, OAUTH_PATH_JWKS, OAUTH_PATH_TOKEN, OAUTH_PATH_AUTHORIZE, OAUTH_PATH_USERINFO}
+		for _, site := range sites {
+			for _, route := range site.StaticRoutes {
+				if path, ok := strings.CutPrefix(route.Path, server.OAuth.PathPrefix); ok && slices.Contains(endpoints, path) {
+					return fmt.Errorf("route %s is shadowed by the %s endpoint, change path_prefix", route.Path, KEY_OAUTH)
+				}
+			}
+		}
+	}
+
+	for _, site := range sites {
+		auths := []*AuthOptions{site.Auth}
+		for _, route := range site.StaticRoutes {
+			auths = append(auths, route.Auth)
+		}
+
+		for _, auth := range auths {
+			if auth == nil || auth.Jwt == nil || !auth.Jwt.OAuth {
+				continue
+			}
+			if server.OAuth == nil {
+				return fmt.Errorf("jwt oauth=true requires the [%s] section", KEY_OAUTH)
+			}
+			if server.OAuth.key != nil {
+				auth.Jwt.rsaKey = &server.OAuth.key.PublicKey
+			} else {
+				auth.Jwt.Secret = server.OAuth.Secret
+			}
+			if auth.Jwt.Issuer == "" {
+				auth.Jwt.Issuer = server.OAuth.Issuer
+			}
+		}
+	}
+	return nil
+}
+
+// serveOAuth handles the endpoints of the mock authorization server, returns false if the request is not one of them
+func (server *HttpServer) serveOAuth(w http.ResponseWriter, r *http.Request) bool {
+	oauth := server.OAuth
+	if oauth == nil {
+		return false
+	}
+
+	path, ok := strings.CutPrefix(r.URL.Path, oauth.PathPrefix)
+	if !ok {
+		return false
+	}
+
+	switch path {
+	case OAUTH_PATH_DISCOVERY:
+		writeJson(w, http.StatusOK, oauth.discovery(r))
+	case OAUTH_PATH_JWKS:
+		writeJson(w, http.StatusOK, oauth.jwks())
+	case OAUTH_PATH_TOKEN:
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return true
+		}
+		// tokens must not be cached
+		w.Header().Set("Cache-Control", "no-store")
+		if resp, err := oauth.token(r); err != nil {
+			if err.code == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+DEFAULT_AUTH_REALM+`"`)
+			}
+			writeJson(w, err.code, err)
+		} else {
+			writeJson(w, http.StatusOK, resp)
+		}
+	case OAUTH_PATH_AUTHORIZE:
+		oauth.authorize(w, r)
+	case OAUTH_PATH_USERINFO:
+		oauth.userinfo(w, r)
+	default:
+		return false
+	}
+	return true
+}
+
+// base returns the url of the endpoints as the request sees them
+func (oauth *OAuthOptions) base(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + oauth.PathPrefix
+}
+
+// issuer returns the configured issuer or the base url
+func (oauth *OAuthOptions) issuer(r *http.Request) string {
+	if oauth.Issuer != "" {
+		return oauth.Issuer
+	}
+	return oauth.base(r)
+}
+
+func (oauth *OAuthOptions) discovery(r *http.Request) map[string]any {
+	base := oauth.base(r)
+
+	return map[string]any{
+		"issuer":                                oauth.issuer(r),
+		"authorization_endpoint":                base + OAUTH_PATH_AUTHORIZE,
+		"token_endpoint":                        base + OAUTH_PATH_TOKEN,
+		"userinfo_endpoint":                     base + OAUTH_PATH_USERINFO,
+		"jwks_uri":                              base + OAUTH_PATH_JWKS,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{GRANT_AUTHORIZATION_CODE, GRANT_CLIENT_CREDENTIALS, GRANT_PASSWORD, GRANT_REFRESH_TOKEN},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{oauth.alg()},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256", "plain"},
+	}
+}
+
+func (oauth *OAuthOptions) alg() string {
+	if oauth.key == nil {
+		return JWT_ALG_HS256
+	}
+	return JWT_ALG_RS256
+}
+
+func (oauth *OAuthOptions) jwks() map[string]any {
+	keys := make([]map[string]any, 0)
+	if oauth.key != nil {
+		pub := oauth.key.PublicKey
+		keys = append(keys, map[string]any{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": JWT_ALG_RS256,
+			"kid": OAUTH_KEY_ID,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+	return map[string]any{"keys": keys}
+}
+
+// sign signs the claims as a jwt
+func (oauth *OAuthOptions) sign(claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": oauth.alg(), "typ": "JWT", "kid": OAUTH_KEY_ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	if oauth.key != nil {
+		digest := sha256.Sum256([]byte(signed))
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, oauth.key, crypto.SHA256, digest[:]); err != nil {
+			return "", err
+		}
+	} else {
+		mac := hmac.New(sha256.New, []byte(oauth.Secret))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// randomString returns a random opaque string for codes and refresh tokens
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// client authenticates the client by basic auth or the form
+func (oauth *OAuthOptions) client(r *http.Request) (string, *OAuthClient, *oauthError) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id == "" {
+		return "", nil, newOAuthError(http.StatusUnauthorized, "invalid_client", "client_id required")
+	}
+	if len(oauth.Clients) == 0 {
+		return id, &OAuthClient{}, nil
+	}
+
+	client, found := oauth.Clients[id]
+	if !found || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		return "", nil, newOAuthError(http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+	}
+	return id, client, nil
+}
+
+// scope checks the requested scope against the ones of the client, all of the client's are granted if none is requested
+func (client *OAuthClient) scope(requested string) (string, *oauthError) {
+	if requested == "" {
+		return strings.Join(client.Scopes, " "), nil
+	}
+	if len(client.Scopes) > 0 {
+		for _, s := range strings.Fields(requested) {
+			if s != OAUTH_SCOPE_OPENID && !slices.Contains(client.Scopes, s) {
+				return "", newOAuthError(http.StatusBadRequest, "invalid_scope", s)
+			}
+		}
+	}
+	return requested, nil
+}
+
+// user checks the password of the user
+func (oauth *OAuthOptions) user(name, password string) (*OAuthUser, bool) {
+	if len(oauth.Users) == 0 {
+		return &OAuthUser{}, name != ""
+	}
+
+	user, found := oauth.Users[name]
+	if !found || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return nil, false
+	}
+	return user, true
+}
+
+// token handles the token endpoint
+func (oauth *OAuthOptions) token(r *http.Request) (map[string]any, *oauthError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, newOAuthError(http.StatusBadRequest, "invalid_request", err.Error())
+	}
+
+	clientId, client, oerr := oauth.client(r)
+	if oerr != nil {
+		return nil, oerr
+	}
+
+	var grant *oauthGrant
+	form := r.PostForm
+	switch form.Get("grant_type") {
+	case GRANT_CLIENT_CREDENTIALS:
+		scope, oerr := client.scope(form.Get("scope"))
+		if oerr != nil {
+			return nil, oerr
+		}
+		grant = &oauthGrant{clientId: clientId, subject: clientId, scope: scope}
+	case GRANT_PASSWORD:
+		if _, ok := oauth.user(form.Get("username"), form.Get("password")); !ok {
+			return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "wrong username or password")
+		}
+		scope, oerr := client.scope(form.Get("scope"))
+		if oerr != nil {
+			return nil, oerr
+		}
+		grant = &oauthGrant{clientId: clientId, subject: form.Get("username"), scope: scope, refreshable: true}
+	case GRANT_REFRESH_TOKEN:
+		grant = oauth.redeem(oauth.tokens, form.Get("refresh_token"), clientId)
+		if grant == nil {
+			return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid refresh token")
+		}
+		grant.nonce = ""
+	case GRANT_AUTHORIZATION_CODE:
+		grant = oauth.redeem(oauth.codes, form.Get("code"), clientId)
+		if grant == nil || grant.redirectUri != form.Get("redirect_uri") {
+			return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid code")
+		}
+		if !verifyCodeChallenge(grant.codeChallenge, form.Get("code_verifier")) {
+			return nil, newOAuthError(http.StatusBadRequest, "invalid_grant", "invalid code verifier")
+		}
+	default:
+		return nil, newOAuthError(http.StatusBadRequest, "unsupported_grant_type", form.Get("grant_type"))
+	}
+
+	return oauth.issue(r, grant, client)
+}
+
+// redeem takes the grant of the code or refresh token, they can be used only once
+func (oauth *OAuthOptions) redeem(grants map[string]*oauthGrant, key string, clientId string) *oauthGrant {
+	oauth.mutex.Lock()
+	defer oauth.mutex.Unlock()
+
+	grant, ok := grants[key]
+	delete(grants, key)
+	if !ok || grant.clientId != clientId || time.Now().After(grant.expires) {
+		return nil
+	}
+	return grant
+}
+
+// store keeps the grant of the code or refresh token, the expired ones are dropped first so that they don't pile up
+func (oauth *OAuthOptions) store(grants map[string]*oauthGrant, key string, grant *oauthGrant) {
+	oauth.mutex.Lock()
+	defer oauth.mutex.Unlock()
+
+	pruneGrants(grants, time.Now())
+	grants[key] = grant
+}
+
+// pruneGrants drops the expired grants
+func pruneGrants(grants map[string]*oauthGrant, now time.Time) {
+	for key, grant := range grants {
+		if now.After(grant.expires) {
+			delete(grants, key)
+		}
+	}
+}
+
+// verifyCodeChallenge checks the pkce verifier, S256 if the challenge is prefixed by it, otherwise plain
+func verifyCodeChallenge(challenge, verifier string) bool {
+	if challenge == "" {
+		return true
+	}
+	if s256, ok := strings.CutPrefix(challenge, "S256:"); ok {
+		digest := sha256.Sum256([]byte(verifier))
+		return base64.RawURLEncoding.EncodeToString(digest[:]) == s256
+	}
+	return challenge == verifier
+}
+
+// claims returns the claims of the tokens of the grant
+func (oauth *OAuthOptions) claims(r *http.Request, grant *oauthGrant, client *OAuthClient, ttl int64) map[string]any {
+	now := time.Now().Unix()
+	claims := make(map[string]any)
+	for k, v := range oauth.Claims {
+		claims[k] = v
+	}
+	for k, v := range client.Claims {
+		claims[k] = v
+	}
+	if user, ok := oauth.Users[grant.subject]; ok {
+		for k, v := range user.Claims {
+			claims[k] = v
+		}
+	}
+
+	aud := oauth.Audience
+	if aud == "" {
+		aud = grant.clientId
+	}
+	claims["iss"] = oauth.issuer(r)
+	claims["sub"] = grant.subject
+	claims["aud"] = aud
+	claims["client_id"] = grant.clientId
+	claims["iat"] = now
+	claims["nbf"] = now
+	claims["exp"] = now + ttl
+	claims["jti"] = randomString()
+	if grant.scope != "" {
+		claims["scope"] = grant.scope
+	}
+	return claims
+}
+
+// issue signs the access token, and the refresh token and id token if they are asked for
+func (oauth *OAuthOptions) issue(r *http.Request, grant *oauthGrant, client *OAuthClient) (map[string]any, *oauthError) {
+	accessToken, err := oauth.sign(oauth.claims(r, grant, client, oauth.AccessTokenTtl))
+	if err != nil {
+		return nil, newOAuthError(http.StatusInternalServerError, "server_error", err.Error())
+	}
+	resp := map[string]any{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   oauth.AccessTokenTtl,
+	}
+	if grant.scope != "" {
+		resp["scope"] = grant.scope
+	}
+
+	if slices.Contains(strings.Fields(grant.scope), OAUTH_SCOPE_OPENID) {
+		claims := oauth.claims(r, grant, client, oauth.AccessTokenTtl)
+		claims["aud"] = grant.clientId
+		delete(claims, "scope")
+		if grant.nonce != "" {
+			claims["nonce"] = grant.nonce
+		}
+		if resp["id_token"], err = oauth.sign(claims); err != nil {
+			return nil, newOAuthError(http.StatusInternalServerError, "server_error", err.Error())
+		}
+	}
+
+	if grant.refreshable {
+		refreshToken := randomString()
+		refreshed := *grant
+		refreshed.expires = time.Now().Add(time.Duration(oauth.RefreshTokenTtl) * time.Second)
+
+		oauth.store(oauth.tokens, refreshToken, &refreshed)
+		resp["refresh_token"] = refreshToken
+	}
+	return resp, nil
+}
+
+// authorize approves the authorization request at once, the user is the login_hint or the first configured one
+func (oauth *OAuthOptions) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	clientId, redirectUri := query.Get("client_id"), query.Get("redirect_uri")
+
+	client := &OAuthClient{}
+	if len(oauth.Clients) > 0 {
+		var found bool
+		if client, found = oauth.Clients[clientId]; !found {
+			writeJson(w, http.StatusBadRequest, newOAuthError(http.StatusBadRequest, "invalid_client", clientId))
+			return
+		}
+	}
+	if len(client.RedirectUris) > 0 && !slices.Contains(client.RedirectUris, redirectUri) {
+		writeJson(w, http.StatusBadRequest, newOAuthError(http.StatusBadRequest, "invalid_request", "redirect_uri not allowed"))
+		return
+	}
+	target, err := url.Parse(redirectUri)
+	if err != nil || redirectUri == "" {
+		writeJson(w, http.StatusBadRequest, newOAuthError(http.StatusBadRequest, "invalid_request", "invalid redirect_uri"))
+		return
+	}
+
+	params := target.Query()
+	if state := query.Get("state"); state != "" {
+		params.Set("state", state)
+	}
+
+	scope, oerr := client.scope(query.Get("scope"))
+	if query.Get("response_type") != "code" {
+		oerr = newOAuthError(http.StatusBadRequest, "unsupported_response_type", query.Get("response_type"))
+	}
+	if oerr != nil {
+		params.Set("error", oerr.Error)
+		params.Set("error_description", oerr.Description)
+		target.RawQuery = params.Encode()
+		http.Redirect(w, r, target.String(), http.StatusFound)
+		return
+	}
+
+	subject := query.Get("login_hint")
+	if subject == "" {
+		subject = DEFAULT_OAUTH_USER
+		if len(oauth.Users) > 0 {
+			names := make([]string, 0, len(oauth.Users))
+			for name := range oauth.Users {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			subject = names[0]
+		}
+	}
+
+	challenge := query.Get("code_challenge")
+	if challenge != "" && query.Get("code_challenge_method") == "S256" {
+		challenge = "S256:" + challenge
+	}
+
+	code := randomString()
+	oauth.store(oauth.codes, code, &oauthGrant{
+		clientId:      clientId,
+		subject:       subject,
+		scope:         scope,
+		nonce:         query.Get("nonce"),
+		redirectUri:   redirectUri,
+		codeChallenge: challenge,
+		expires:       time.Now().Add(OAUTH_CODE_TTL),
+		refreshable:   true,
+	})
+
+	params.Set("code", code)
+	target.RawQuery = params.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// userinfo returns the claims of the access token
+func (oauth *OAuthOptions) userinfo(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	verifier := &JwtOptions{Secret: oauth.Secret}
+	if oauth.key != nil {
+		verifier.rsaKey = &oauth.key.PublicKey
+	}
+	claims, err := verifier.verify(strings.TrimSpace(token))
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="invalid_token", error_description="%s"`, err.message))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	info := map[string]any{"sub": claims["sub"]}
+	if user, ok := oauth.Users[fmt.Sprint(claims["sub"])]; ok {
+		for k, v := range user.Claims {
+			info[k] = v
+		}
+	}
+	writeJson(w, http.StatusOK, info)
+}
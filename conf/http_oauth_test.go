@@ -0,0 +1,154 @@
+package conf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newOAuth(t *testing.T) *OAuthOptions {
+	t.Helper()
+
+	oauth := &OAuthOptions{
+		Secret:         testSecret,
+		AccessTokenTtl: 60,
+		Clients:        map[string]*OAuthClient{"app": {Secret: "s", Scopes: []string{"orders:read"}}},
+		Users:          map[string]*OAuthUser{"alice": {Password: "pw"}},
+	}
+	if err := oauth.compile(false); err != nil {
+		t.Fatal(err)
+	}
+	return oauth
+}
+
+func tokenRequest(form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", "/oauth/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestOAuthToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		form    url.Values
+		setup   func(oauth *OAuthOptions)
+		err     string
+		subject string
+		refresh bool
+	}{
+		{"client credentials", url.Values{"grant_type": {GRANT_CLIENT_CREDENTIALS}, "client_id": {"app"}, "client_secret": {"s"}},
+			nil, "", "app", false},
+		{"wrong client secret", url.Values{"grant_type": {GRANT_CLIENT_CREDENTIALS}, "client_id": {"app"}, "client_secret": {"x"}},
+			nil, "invalid_client", "", false},
+		{"scope not allowed", url.Values{"grant_type": {GRANT_CLIENT_CREDENTIALS}, "client_id": {"app"}, "client_secret": {"s"}, "scope": {"admin"}},
+			nil, "invalid_scope", "", false},
+		{"password", url.Values{"grant_type": {GRANT_PASSWORD}, "client_id": {"app"}, "client_secret": {"s"}, "username": {"alice"}, "password": {"pw"}},
+			nil, "", "alice", true},
+		{"wrong password", url.Values{"grant_type": {GRANT_PASSWORD}, "client_id": {"app"}, "client_secret": {"s"}, "username": {"alice"}, "password": {"px"}},
+			nil, "invalid_grant", "", false},
+		{"refresh token", url.Values{"grant_type": {GRANT_REFRESH_TOKEN}, "client_id": {"app"}, "client_secret": {"s"}, "refresh_token": {"r1"}},
+			func(oauth *OAuthOptions) {
+				oauth.tokens["r1"] = &oauthGrant{clientId: "app", subject: "alice", expires: time.Now().Add(time.Minute), refreshable: true}
+			}, "", "alice", true},
+		{"expired refresh token", url.Values{"grant_type": {GRANT_REFRESH_TOKEN}, "client_id": {"app"}, "client_secret": {"s"}, "refresh_token": {"r1"}},
+			func(oauth *OAuthOptions) {
+				oauth.tokens["r1"] = &oauthGrant{clientId: "app", subject: "alice", expires: time.Now().Add(-time.Second), refreshable: true}
+			}, "invalid_grant", "", false},
+		{"refresh token of another client", url.Values{"grant_type": {GRANT_REFRESH_TOKEN}, "client_id": {"app"}, "client_secret": {"s"}, "refresh_token": {"r1"}},
+			func(oauth *OAuthOptions) {
+				oauth.tokens["r1"] = &oauthGrant{clientId: "other", subject: "alice", expires: time.Now().Add(time.Minute), refreshable: true}
+			}, "invalid_grant", "", false},
+		{"expired code", url.Values{"grant_type": {GRANT_AUTHORIZATION_CODE}, "client_id": {"app"}, "client_secret": {"s"}, "code": {"c1"}},
+			func(oauth *OAuthOptions) {
+				oauth.codes["c1"] = &oauthGrant{clientId: "app", subject: "alice", expires: time.Now().Add(-time.Second)}
+			}, "invalid_grant", "", false},
+		{"unsupported grant", url.Values{"grant_type": {"implicit"}, "client_id": {"app"}, "client_secret": {"s"}},
+			nil, "unsupported_grant_type", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oauth := newOAuth(t)
+			if tt.setup != nil {
+				tt.setup(oauth)
+			}
+
+			resp, oerr := oauth.token(tokenRequest(tt.form))
+			if tt.err != "" {
+				if oerr == nil || oerr.Error != tt.err {
+					t.Fatalf("error = %v, want %s", oerr, tt.err)
+				}
+				return
+			}
+			if oerr != nil {
+				t.Fatalf("error = %s: %s", oerr.Error, oerr.Description)
+			}
+
+			claims, err := (&JwtOptions{Secret: testSecret}).verify(resp["access_token"].(string))
+			if err != nil {
+				t.Fatalf("access token: %s", err.message)
+			}
+			if claims["sub"] != tt.subject {
+				t.Errorf("sub = %v, want %s", claims["sub"], tt.subject)
+			}
+			if exp, iat := claims["exp"].(float64), claims["iat"].(float64); exp-iat != 60 || resp["expires_in"] != int64(60) {
+				t.Errorf("the token expires in %v, expires_in = %v", exp-iat, resp["expires_in"])
+			}
+			if _, ok := resp["refresh_token"]; ok != tt.refresh {
+				t.Errorf("refresh token issued = %v, want %v", ok, tt.refresh)
+			}
+		})
+	}
+}
+
+func TestOAuthRefreshTokenOnce(t *testing.T) {
+	oauth := newOAuth(t)
+	form := url.Values{"grant_type": {GRANT_PASSWORD}, "client_id": {"app"}, "client_secret": {"s"}, "username": {"alice"}, "password": {"pw"}}
+	resp, oerr := oauth.token(tokenRequest(form))
+	if oerr != nil {
+		t.Fatal(oerr.Error)
+	}
+
+	form = url.Values{"grant_type": {GRANT_REFRESH_TOKEN}, "client_id": {"app"}, "client_secret": {"s"}, "refresh_token": {resp["refresh_token"].(string)}}
+	if _, oerr := oauth.token(tokenRequest(form)); oerr != nil {
+		t.Fatalf("refresh: %s", oerr.Error)
+	}
+	if _, oerr := oauth.token(tokenRequest(form)); oerr == nil {
+		t.Error("the refresh token is used twice")
+	}
+}
+
+func TestOAuthPruneGrants(t *testing.T) {
+	oauth := newOAuth(t)
+	now := time.Now()
+	oauth.tokens["expired"] = &oauthGrant{clientId: "app", expires: now.Add(-time.Second)}
+	oauth.tokens["live"] = &oauthGrant{clientId: "app", expires: now.Add(time.Hour)}
+	oauth.codes["expired"] = &oauthGrant{clientId: "app", expires: now.Add(-time.Second)}
+
+	form := url.Values{"grant_type": {GRANT_PASSWORD}, "client_id": {"app"}, "client_secret": {"s"}, "username": {"alice"}, "password": {"pw"}}
+	if _, oerr := oauth.token(tokenRequest(form)); oerr != nil {
+		t.Fatal(oerr.Error)
+	}
+	if _, ok := oauth.tokens["expired"]; ok {
+		t.Error("the expired refresh token is kept")
+	}
+	if _, ok := oauth.tokens["live"]; !ok {
+		t.Error("the live refresh token is dropped")
+	}
+	if len(oauth.tokens) != 2 {
+		t.Errorf("tokens = %d, want 2", len(oauth.tokens))
+	}
+
+	r := httptest.NewRequest("GET", "/oauth/authorize?response_type=code&client_id=app&redirect_uri=http://app/cb", nil)
+	w := httptest.NewRecorder()
+	oauth.authorize(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("authorize code = %d", w.Code)
+	}
+	if _, ok := oauth.codes["expired"]; ok || len(oauth.codes) != 1 {
+		t.Errorf("codes = %d, the expired one is kept", len(oauth.codes))
+	}
+}
@@ -0,0 +1,713 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/zddava/gowrap/json"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	OPENAPI_REF_PREFIX = "#/components/schemas/"
+	OPENAPI_MAX_DEPTH  = 8
+)
+
+type (
+	OpenApiDoc struct {
+		OpenApi    string                      `json:"openapi"`
+		Info       OpenApiInfo                 `json:"info"`
+		Paths      map[string]*OpenApiPathItem `json:"paths"`
+		Components OpenApiComponents           `json:"components,omitempty"`
+	}
+
+	OpenApiInfo struct {
+		Title   string `json:"title"`
+		Version string `json:"version"`
+	}
+
+	OpenApiComponents struct {
+		Schemas map[string]*OpenApiSchema `json:"schemas,omitempty"`
+	}
+
+	OpenApiPathItem struct {
+		Parameters []*OpenApiParameter `json:"parameters,omitempty"`
+		Get        *OpenApiOperation   `json:"get,omitempty"`
+		Put        *OpenApiOperation   `json:"put,omitempty"`
+		Post       *OpenApiOperation   `json:"post,omitempty"`
+		Delete     *OpenApiOperation   `json:"delete,omitempty"`
+	}
+
+	OpenApiOperation struct {
+		OperationId string                      `json:"operationId,omitempty"`
+		Summary     string                      `json:"summary,omitempty"`
+		Parameters  []*OpenApiParameter         `json:"parameters,omitempty"`
+		RequestBody *OpenApiRequestBody         `json:"requestBody,omitempty"`
+		Responses   map[string]*OpenApiResponse `json:"responses"`
+		SmockAction string                      `json:"x-smock-action,omitempty"`
+		SmockId     []string                    `json:"x-smock-id,omitempty"`
+	}
+
+	OpenApiParameter struct {
+		Name     string         `json:"name"`
+		In       string         `json:"in"`
+		Required bool           `json:"required,omitempty"`
+		Schema   *OpenApiSchema `json:"schema,omitempty"`
+	}
+
+	OpenApiRequestBody struct {
+		Required bool                         `json:"required,omitempty"`
+		Content  map[string]*OpenApiMediaType `json:"content,omitempty"`
+	}
+
+	OpenApiResponse struct {
+		Description string                       `json:"description"`
+		Content     map[string]*OpenApiMediaType `json:"content,omitempty"`
+	}
+
+	OpenApiMediaType struct {
+		Schema   *OpenApiSchema             `json:"schema,omitempty"`
+		Example  any                        `json:"example,omitempty"`
+		Examples map[string]*OpenApiExample `json:"examples,omitempty"`
+	}
+
+	OpenApiExample struct {
+		Value any `json:"value,omitempty"`
+	}
+
+	OpenApiSchema struct {
+		Ref        string                    `json:"$ref,omitempty"`
+		Type       any                       `json:"type,omitempty"`
+		Format     string                    `json:"format,omitempty"`
+		Nullable   bool                      `json:"nullable,omitempty"`
+		Properties map[string]*OpenApiSchema `json:"properties,omitempty"`
+		Items      *OpenApiSchema            `json:"items,omitempty"`
+		Required   []string                  `json:"required,omitempty"`
+		Enum       []any                     `json:"enum,omitempty"`
+		Example    any                       `json:"example,omitempty"`
+		Default    any                       `json:"default,omitempty"`
+		AllOf      []*OpenApiSchema          `json:"allOf,omitempty"`
+		OneOf      []*OpenApiSchema          `json:"oneOf,omitempty"`
+		AnyOf      []*OpenApiSchema          `json:"anyOf,omitempty"`
+
+		target *OpenApiSchema
+	}
+
+	// OpenApiRoute is a route generated from an openapi operation
+	OpenApiRoute struct {
+		Name          string
+		Info          RouteInfo
+		RequestSchema *OpenApiSchema
+		ReplySchema   *OpenApiSchema
+		Sample        any
+	}
+)
+
+var (
+	nameSanitizer = regexp.MustCompile(`[^A-Za-z0-9]+`)
+)
+
+// LoadOpenApi loads an openapi 3 document in json or yaml
+func LoadOpenApi(file string) (*OpenApiDoc, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &OpenApiDoc{}
+	if strings.ToLower(filepath.Ext(file)) == ".json" {
+		err = json.Unmarshal(data, doc)
+	} else {
+		var m any
+		if err = yaml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		err = json.Convert(doc, normalizeYaml(m))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(doc.OpenApi, "3.") {
+		return nil, fmt.Errorf("unsupported openapi version: %s", doc.OpenApi)
+	}
+
+	doc.link()
+	return doc, nil
+}
+
+// normalizeYaml converts the map[any]any produced by yaml, e.g. for status code keys, to map[string]any
+func normalizeYaml(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		for k, item := range val {
+			val[k] = normalizeYaml(item)
+		}
+		return val
+	case map[any]any:
+		m := make(map[string]any, len(val))
+		for k, item := range val {
+			m[fmt.Sprint(k)] = normalizeYaml(item)
+		}
+		return m
+	case []any:
+		for i, item := range val {
+			val[i] = normalizeYaml(item)
+		}
+		return val
+	}
+	return v
+}
+
+// link resolves the $ref of every schema to the schema in components
+func (doc *OpenApiDoc) link() {
+	visited := make(map[*OpenApiSchema]bool)
+
+	var walk func(schema *OpenApiSchema)
+	walk = func(schema *OpenApiSchema) {
+		if schema == nil || visited[schema] {
+			return
+		}
+		visited[schema] = true
+
+		if name, ok := strings.CutPrefix(schema.Ref, OPENAPI_REF_PREFIX); ok {
+			schema.target = doc.Components.Schemas[name]
+		} else if schema.Ref != "" {
+			log.Printf("unsupported openapi $ref: %s", schema.Ref)
+		}
+
+		for _, prop := range schema.Properties {
+			walk(prop)
+		}
+		walk(schema.Items)
+		for _, list := range [][]*OpenApiSchema{schema.AllOf, schema.OneOf, schema.AnyOf} {
+			for _, sub := range list {
+				walk(sub)
+			}
+		}
+	}
+
+	for _, schema := range doc.Components.Schemas {
+		walk(schema)
+	}
+	for _, item := range doc.Paths {
+		for _, op := range item.operations() {
+			if op.RequestBody != nil {
+				for _, mt := range op.RequestBody.Content {
+					walk(mt.Schema)
+				}
+			}
+			for _, resp := range op.Responses {
+				if resp == nil {
+					continue
+				}
+				for _, mt := range resp.Content {
+					walk(mt.Schema)
+				}
+			}
+		}
+	}
+}
+
+func (item *OpenApiPathItem) operations() map[string]*OpenApiOperation {
+	ops := make(map[string]*OpenApiOperation)
+	if item.Get != nil {
+		ops[HTTP_METHOD_GET.Code] = item.Get
+	}
+	if item.Post != nil {
+		ops[HTTP_METHOD_POST.Code] = item.Post
+	}
+	if item.Put != nil {
+		ops[HTTP_METHOD_PUT.Code] = item.Put
+	}
+	if item.Delete != nil {
+		ops[HTTP_METHOD_DELETE.Code] = item.Delete
+	}
+	return ops
+}
+
+// deref follows the $ref of the schema
+func (schema *OpenApiSchema) deref() *OpenApiSchema {
+	for i := 0; schema != nil && schema.Ref != "" && i < OPENAPI_MAX_DEPTH; i++ {
+		schema = schema.target
+	}
+	return schema
+}
+
+// typ returns the type of the schema, the first non-null one if it's a list in openapi 3.1
+func (schema *OpenApiSchema) typ() string {
+	switch t := schema.Type.(type) {
+	case string:
+		return t
+	case []any:
+		for _, item := range t {
+			if s, ok := item.(string); ok && s != "null" {
+				return s
+			}
+		}
+	}
+
+	if len(schema.Properties) > 0 {
+		return "object"
+	}
+	if schema.Items != nil {
+		return "array"
+	}
+	return ""
+}
+
+// Sample builds an example value from the schema
+func (schema *OpenApiSchema) Sample() any {
+	return schema.sample(0)
+}
+
+func (schema *OpenApiSchema) sample(depth int) any {
+	schema = schema.deref()
+	if schema == nil || depth > OPENAPI_MAX_DEPTH {
+		return nil
+	}
+
+	if schema.Example != nil {
+		return schema.Example
+	}
+	if schema.Default != nil {
+		return schema.Default
+	}
+	if len(schema.Enum) > 0 {
+		return schema.Enum[0]
+	}
+
+	if len(schema.AllOf) > 0 {
+		merged := make(map[string]any)
+		for _, sub := range schema.AllOf {
+			if m, ok := sub.sample(depth + 1).(map[string]any); ok {
+				for k, v := range m {
+					merged[k] = v
+				}
+			}
+		}
+		return merged
+	}
+	if len(schema.OneOf) > 0 {
+		return schema.OneOf[0].sample(depth + 1)
+	}
+	if len(schema.AnyOf) > 0 {
+		return schema.AnyOf[0].sample(depth + 1)
+	}
+
+	switch schema.typ() {
+	case "object":
+		obj := make(map[string]any)
+		for name, prop := range schema.Properties {
+			obj[name] = prop.sample(depth + 1)
+		}
+		return obj
+	case "array":
+		if schema.Items == nil {
+			return []any{}
+		}
+		return []any{schema.Items.sample(depth + 1)}
+	case "integer", "number":
+		return 0
+	case "boolean":
+		return false
+	case "string":
+		switch schema.Format {
+		case "date-time":
+			return "2023-01-01T00:00:00Z"
+		case "date":
+			return "2023-01-01"
+		case "email":
+			return "user@example.com"
+		case "uuid":
+			return "00000000-0000-0000-0000-000000000000"
+		}
+		return "string"
+	}
+
+	return nil
+}
+
+// Validate checks the value against the schema, returns the mismatches
+func (schema *OpenApiSchema) Validate(v any) []string {
+	// normalize to the generic json types
+	var normalized any
+	if err := json.Convert(&normalized, v); err != nil {
+		return []string{err.Error()}
+	}
+	return schema.validate(normalized, "$", 0)
+}
+
+func (schema *OpenApiSchema) validate(v any, path string, depth int) (errs []string) {
+	schema = schema.deref()
+	if schema == nil || depth > OPENAPI_MAX_DEPTH {
+		return nil
+	}
+
+	if v == nil {
+		if schema.Nullable || schema.typ() == "" {
+			return nil
+		}
+		return []string{path + ": must not be null"}
+	}
+
+	for _, sub := range schema.AllOf {
+		errs = append(errs, sub.validate(v, path, depth+1)...)
+	}
+	alternatives := make([]*OpenApiSchema, 0, len(schema.OneOf)+len(schema.AnyOf))
+	alternatives = append(append(alternatives, schema.OneOf...), schema.AnyOf...)
+	if len(alternatives) > 0 {
+		matched := false
+		for _, sub := range alternatives {
+			if len(sub.validate(v, path, depth+1)) == 0 {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			errs = append(errs, path+": matches none of the alternatives")
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		found := false
+		for _, item := range schema.Enum {
+			if fmt.Sprint(item) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", path, v, schema.Enum))
+		}
+	}
+
+	switch schema.typ() {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return append(errs, path+": should be object")
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				errs = append(errs, path+"."+name+": is required")
+			}
+		}
+		for name, prop := range schema.Properties {
+			if val, ok := obj[name]; ok {
+				errs = append(errs, prop.validate(val, path+"."+name, depth+1)...)
+			}
+		}
+	case "array":
+		list, ok := v.([]any)
+		if !ok {
+			return append(errs, path+": should be array")
+		}
+		if schema.Items != nil {
+			for i, item := range list {
+				errs = append(errs, schema.Items.validate(item, path+"["+strconv.Itoa(i)+"]", depth+1)...)
+			}
+		}
+	case "string":
+		if _, ok := v.(string); !ok {
+			errs = append(errs, path+": should be string")
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != math.Trunc(f) {
+			errs = append(errs, path+": should be integer")
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			errs = append(errs, path+": should be number")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			errs = append(errs, path+": should be boolean")
+		}
+	}
+
+	return errs
+}
+
+// jsonMediaType picks the json content of an openapi body, or the first one
+func jsonMediaType(content map[string]*OpenApiMediaType) *OpenApiMediaType {
+	if mt, ok := content[MIME_TYPE_JSON]; ok {
+		return mt
+	}
+
+	types := make([]string, 0, len(content))
+	for t := range content {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		if strings.HasSuffix(t, "json") {
+			return content[t]
+		}
+	}
+	return nil
+}
+
+// sample returns the example of the media type, or one built from its schema
+func (mt *OpenApiMediaType) sample() any {
+	if mt.Example != nil {
+		return mt.Example
+	}
+
+	names := make([]string, 0, len(mt.Examples))
+	for name := range mt.Examples {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if ex := mt.Examples[name]; ex != nil && ex.Value != nil {
+			return ex.Value
+		}
+	}
+
+	return mt.Schema.Sample()
+}
+
+// successResponse returns the first 2xx response of the operation, or the default one
+func (op *OpenApiOperation) successResponse() *OpenApiResponse {
+	codes := make([]string, 0, len(op.Responses))
+	for code := range op.Responses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	for _, code := range codes {
+		if strings.HasPrefix(code, "2") {
+			return op.Responses[code]
+		}
+	}
+	return op.Responses["default"]
+}
+
+// Routes generates a route for every supported operation of the document
+func (doc *OpenApiDoc) Routes() []OpenApiRoute {
+	paths := make([]string, 0, len(doc.Paths))
+	for path := range doc.Paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	routes := make([]OpenApiRoute, 0)
+	names := make(map[string]bool)
+	for _, path := range paths {
+		item := doc.Paths[path]
+		if item == nil {
+			continue
+		}
+
+		ops := item.operations()
+		methods := make([]string, 0, len(ops))
+		for method := range ops {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+
+		for _, method := range methods {
+			op := ops[method]
+			or := OpenApiRoute{Info: RouteInfo{Path: path, Method: method}}
+
+			or.Name = strings.Trim(nameSanitizer.ReplaceAllString(op.OperationId, "_"), "_")
+			if or.Name == "" {
+				or.Name = strings.Trim(nameSanitizer.ReplaceAllString(strings.ToLower(method)+"_"+path, "_"), "_")
+			}
+			for base, i := or.Name, 2; names[or.Name]; i++ {
+				or.Name = base + "_" + strconv.Itoa(i)
+			}
+			names[or.Name] = true
+
+			if op.RequestBody != nil {
+				if mt := jsonMediaType(op.RequestBody.Content); mt != nil {
+					or.RequestSchema = mt.Schema
+				}
+			}
+
+			if resp := op.successResponse(); resp != nil {
+				if mt := jsonMediaType(resp.Content); mt != nil {
+					or.ReplySchema = mt.Schema
+					or.Sample = mt.sample()
+				}
+			}
+
+			// a single object on a templated path is an item of the list
+			if method == HTTP_METHOD_GET.Code {
+				if _, isObj := or.Sample.(map[string]any); isObj {
+					if strings.Contains(path, "{") {
+						or.Info.UniqueNotList = true
+					} else {
+						or.Info.Single = true
+					}
+				}
+			}
+
+			routes = append(routes, or)
+		}
+	}
+
+	return routes
+}
+
+// fill puts the sample of the route into the data file model
+func (or OpenApiRoute) fill(model *HttpFileModel) {
+	switch or.Info.Method {
+	case HTTP_METHOD_GET.Code:
+		switch sample := or.Sample.(type) {
+		case []any:
+			model.Data = append(model.Data, sample...)
+		case map[string]any:
+			if or.Info.Single {
+				model.Datum = sample
+			} else if len(model.Data) == 0 {
+				model.Data = append(model.Data, sample)
+			}
+		}
+	case HTTP_METHOD_POST.Code, HTTP_METHOD_PUT.Code:
+		if sample, ok := or.Sample.(map[string]any); ok {
+			model.PostResponse = sample
+		}
+	case HTTP_METHOD_DELETE.Code:
+		if sample, ok := or.Sample.(map[string]any); ok {
+			model.DelResponse = sample
+		}
+	}
+}
+
+// writeModels writes the data files which do not exist yet, empty models are skipped
+func writeModels(models map[string]*HttpFileModel, resolvers map[string]HttpFileResolver) error {
+	for file, model := range models {
+		if FileExists(file) {
+			continue
+		}
+		if len(model.Data) == 0 && model.Datum == nil && model.PostResponse == nil && model.DelResponse == nil {
+			continue
+		}
+
+		bytes, err := resolvers[file].Marshal(model)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, bytes, 0666); err != nil {
+			return err
+		}
+		log.Printf("data file generated: %s", file)
+	}
+
+	return nil
+}
+
+// loadOpenApi adds the routes of the openapi document which are not configured statically
+func (server *HttpServer) loadOpenApi() error {
+	doc, err := LoadOpenApi(server.OpenApi)
+	if err != nil {
+		return err
+	}
+
+	models := make(map[string]*HttpFileModel)
+	resolvers := make(map[string]HttpFileResolver)
+	for _, or := range doc.Routes() {
+		key, route, err := or.Info.resolve(server.DBRoot)
+		if err != nil {
+			return err
+		}
+		if _, ok := server.StaticRoutes[key]; ok {
+			continue
+		}
+
+		if server.OpenApiValidate {
+			route.RequestSchema = or.RequestSchema
+			route.ReplySchema = or.ReplySchema
+		}
+		server.StaticRoutes[key] = route
+
+		if _, ok := models[route.File]; !ok {
+			models[route.File] = &HttpFileModel{}
+			resolvers[route.File] = route.Resolver
+		}
+		or.fill(models[route.File])
+	}
+
+	if server.dryRun {
+		return nil
+	}
+	return writeModels(models, resolvers)
+}
+
+// ImportOpenApi writes the route sections generated from the openapi document to out,
+// and the data files under root
+func ImportOpenApi(spec string, root string, out io.Writer) error {
+	doc, err := LoadOpenApi(spec)
+	if err != nil {
+		return err
+	}
+
+	rim := make(RouteInfoMap)
+	models := make(map[string]*HttpFileModel)
+	resolvers := make(map[string]HttpFileResolver)
+	for _, or := range doc.Routes() {
+		rim[or.Name] = or.Info
+
+		_, route, err := or.Info.resolve(root)
+		if err != nil {
+			return err
+		}
+		if _, ok := models[route.File]; !ok {
+			models[route.File] = &HttpFileModel{}
+			resolvers[route.File] = route.Resolver
+		}
+		or.fill(models[route.File])
+	}
+
+	if err := writeModels(models, resolvers); err != nil {
+		return err
+	}
+
+	return toml.NewEncoder(out).Encode(rim)
+}
+
+// validateRequest checks the request body against the openapi schema, responds 400 if it mismatches
+func (route Route) validateRequest(w http.ResponseWriter, r *http.Request) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var errs []string
+	var v any
+	if err := route.Resolver.Unmarshal(body, &v); err != nil {
+		errs = []string{err.Error()}
+	} else {
+		errs = route.RequestSchema.Validate(v)
+	}
+
+	if len(errs) == 0 {
+		return true
+	}
+
+	w.Header().Set("Content-Type", route.ReplyResolver.ContentType())
+	w.WriteHeader(http.StatusBadRequest)
+	if bytes, err := route.ReplyResolver.Marshal(map[string]any{"errors": errs}); err == nil {
+		w.Write(bytes)
+	}
+	return false
+}
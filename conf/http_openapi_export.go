@@ -0,0 +1,238 @@
+package conf
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zddava/gowrap/json"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	OPENAPI_VERSION = "3.0.3"
+)
+
+// inferSchema builds a schema from the shape of a value decoded by a resolver
+func inferSchema(v any) *OpenApiSchema {
+	switch val := v.(type) {
+	case nil:
+		return &OpenApiSchema{Nullable: true}
+	case map[string]any:
+		schema := &OpenApiSchema{Type: "object", Properties: make(map[string]*OpenApiSchema)}
+		for k, item := range val {
+			schema.Properties[k] = inferSchema(item)
+		}
+		return schema
+	case []any:
+		schema := &OpenApiSchema{Type: "array"}
+		for _, item := range val {
+			schema.Items = mergeSchema(schema.Items, inferSchema(item))
+		}
+		if schema.Items == nil {
+			schema.Items = &OpenApiSchema{}
+		}
+		return schema
+	case string:
+		return &OpenApiSchema{Type: "string"}
+	case bool:
+		return &OpenApiSchema{Type: "boolean"}
+	case float64:
+		if val == math.Trunc(val) {
+			return &OpenApiSchema{Type: "integer"}
+		}
+		return &OpenApiSchema{Type: "number"}
+	case int, int64:
+		return &OpenApiSchema{Type: "integer"}
+	}
+
+	// anything else, e.g. structs, goes through json first
+	var normalized any
+	if err := json.Convert(&normalized, v); err != nil {
+		return &OpenApiSchema{}
+	}
+	return inferSchema(normalized)
+}
+
+// mergeSchema merges the properties of two object schemas, the first type wins otherwise
+func mergeSchema(a, b *OpenApiSchema) *OpenApiSchema {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+
+	if a.typ() == "integer" && b.typ() == "number" {
+		return b
+	}
+	if a.typ() != b.typ() {
+		return a
+	}
+
+	switch a.typ() {
+	case "object":
+		for k, prop := range b.Properties {
+			a.Properties[k] = mergeSchema(a.Properties[k], prop)
+		}
+	case "array":
+		a.Items = mergeSchema(a.Items, b.Items)
+	}
+	return a
+}
+
+// project keeps only the given properties of an object schema, or the items of an array schema
+func (schema *OpenApiSchema) project(fields []string) *OpenApiSchema {
+	if schema == nil || len(fields) == 0 {
+		return schema
+	}
+
+	switch schema.typ() {
+	case "object":
+		for k := range schema.Properties {
+			if !slices.Contains(fields, k) {
+				delete(schema.Properties, k)
+			}
+		}
+	case "array":
+		schema.Items = schema.Items.project(fields)
+	}
+	return schema
+}
+
+// peekModel reads the data file of the route, an empty model if it does not exist or fails to parse
+func (route Route) peekModel() (model HttpFileModel) {
+	if bytes, err := os.ReadFile(route.File); err == nil {
+		route.Resolver.Unmarshal(bytes, &model)
+	}
+	return
+}
+
+// operation describes the route as an openapi operation
+func (route Route) operation(key string) *OpenApiOperation {
+	model := route.peekModel()
+	content := func(schema *OpenApiSchema) map[string]*OpenApiMediaType {
+		return map[string]*OpenApiMediaType{route.Resolver.ContentType(): {Schema: schema}}
+	}
+
+	op := &OpenApiOperation{
+		OperationId: key,
+		SmockAction: route.Action.Name,
+		SmockId:     route.Id,
+		Responses:   make(map[string]*OpenApiResponse),
+	}
+
+	for _, segment := range route.Segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			op.Parameters = append(op.Parameters, &OpenApiParameter{
+				Name:     segment[1 : len(segment)-1],
+				In:       "path",
+				Required: true,
+				Schema:   &OpenApiSchema{Type: "string"},
+			})
+		}
+	}
+
+	item := inferSchema(model.Data).Items
+	if item.typ() == "" {
+		item = &OpenApiSchema{Type: "object"}
+	}
+
+	// request
+	switch route.Action {
+	case HTTP_ACTION_READ, HTTP_ACTION_DELETE:
+		if !route.Single {
+			names := make([]string, 0, len(item.Properties))
+			for name := range item.Properties {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if !slices.ContainsFunc(op.Parameters, func(p *OpenApiParameter) bool { return p.Name == name }) {
+					op.Parameters = append(op.Parameters, &OpenApiParameter{Name: name, In: "query", Schema: &OpenApiSchema{Type: "string"}})
+				}
+			}
+		}
+	case HTTP_ACTION_APPEND, HTTP_ACTION_WRITE:
+		var schema *OpenApiSchema
+		if route.Action == HTTP_ACTION_WRITE {
+			schema = inferSchema(model.Datum)
+		} else {
+			schema = item
+			schema.Required = route.Id
+		}
+		if route.Method == HTTP_METHOD_POST || route.Method == HTTP_METHOD_PUT {
+			op.RequestBody = &OpenApiRequestBody{Required: true, Content: content(schema)}
+		}
+	}
+
+	// response
+	var reply *OpenApiSchema
+	switch route.Action {
+	case HTTP_ACTION_READ:
+		if route.Single {
+			reply = inferSchema(model.Datum)
+		} else if route.UniqueNotList {
+			reply = &OpenApiSchema{OneOf: []*OpenApiSchema{item, {Type: "array", Items: item}}}
+		} else {
+			reply = &OpenApiSchema{Type: "array", Items: item}
+		}
+		reply = reply.project(route.Fields)
+	case HTTP_ACTION_DELETE:
+		if len(model.DelResponse) > 0 {
+			reply = inferSchema(model.DelResponse)
+		} else {
+			reply = inferSchema(DEFAULT_RESPONSE)
+		}
+	default:
+		if len(model.PostResponse) > 0 {
+			reply = inferSchema(model.PostResponse)
+		} else {
+			reply = inferSchema(DEFAULT_RESPONSE)
+		}
+	}
+	op.Responses["200"] = &OpenApiResponse{Description: "OK", Content: content(reply)}
+
+	return op
+}
+
+// ExportOpenApi describes the static routes of the server as an openapi document
+func (server *HttpServer) ExportOpenApi() *OpenApiDoc {
+	doc := &OpenApiDoc{
+		OpenApi: OPENAPI_VERSION,
+		Info:    OpenApiInfo{Title: "smock", Version: "1.0"},
+		Paths:   make(map[string]*OpenApiPathItem),
+	}
+
+	for key, route := range server.StaticRoutes {
+		if route.Method == nil || route.Action == nil || route.Resolver == nil {
+			continue
+		}
+
+		item, ok := doc.Paths[route.Path]
+		if !ok {
+			item = &OpenApiPathItem{}
+			doc.Paths[route.Path] = item
+		}
+
+		op := route.operation(key)
+		switch route.Method {
+		case HTTP_METHOD_GET:
+			item.Get = op
+		case HTTP_METHOD_POST:
+			item.Post = op
+		case HTTP_METHOD_PUT:
+			item.Put = op
+		case HTTP_METHOD_DELETE:
+			item.Delete = op
+		}
+	}
+
+	return doc
+}
+
+func (server *HttpServer) serveOpenApi(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, server.site(r.Host).ExportOpenApi())
+}
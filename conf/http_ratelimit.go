@@ -0,0 +1,311 @@
+package conf
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KEY_RATE_LIMIT = "rate_limit"
+
+	RATE_LIMIT_TOKEN_BUCKET = "token_bucket"
+	RATE_LIMIT_FIXED_WINDOW = "fixed_window"
+
+	RATE_LIMIT_KEY_IP      = "ip"
+	RATE_LIMIT_KEY_API_KEY = "api_key"
+	RATE_LIMIT_KEY_HEADER  = "header:"
+
+	RATE_LIMIT_GLOBAL = "global"
+)
+
+type (
+	// RateLimitOptions describes the limit of a site or a route, the counters of a site are shared by its routes
+	RateLimitOptions struct {
+		// token_bucket(default) or fixed_window
+		Algorithm string `toml:"algorithm,omitempty"`
+		// requests in the window, also the size of the bucket
+		Limit int64 `toml:"limit,omitempty"`
+		// seconds, the default is 1
+		Window int64 `toml:"window,omitempty"`
+		// how the clients are told apart: ip(default), api_key or header:<name>
+		Key string `toml:"key,omitempty"`
+		// turns off the limit of the site for a route
+		Disabled bool `toml:"disabled,omitempty"`
+
+		name     string
+		mutex    sync.Mutex
+		counters map[string]*rateCounter
+	}
+
+	rateCounter struct {
+		// tokens left in the bucket, or requests in the window
+		tokens float64
+		count  int64
+		last   time.Time
+	}
+
+	// RateLimitStatus is the state of a counter shown by the admin endpoint
+	RateLimitStatus struct {
+		Remaining int64 `json:"remaining"`
+		// seconds
+		Reset int64 `json:"reset"`
+	}
+
+	RateLimitInfo struct {
+		Name      string                     `json:"name"`
+		Algorithm string                     `json:"algorithm"`
+		Limit     int64                      `json:"limit"`
+		Window    int64                      `json:"window"`
+		Key       string                     `json:"key"`
+		Counters  map[string]RateLimitStatus `json:"counters"`
+	}
+)
+
+// compile checks the options and fills the defaults
+func (limit *RateLimitOptions) compile(name string) error {
+	limit.name = name
+	limit.counters = make(map[string]*rateCounter)
+	if limit.Disabled {
+		return nil
+	}
+
+	if limit.Algorithm == "" {
+		limit.Algorithm = RATE_LIMIT_TOKEN_BUCKET
+	}
+	if limit.Algorithm != RATE_LIMIT_TOKEN_BUCKET && limit.Algorithm != RATE_LIMIT_FIXED_WINDOW {
+		return fmt.Errorf("unknown rate limit algorithm: %s", limit.Algorithm)
+	}
+	if limit.Limit <= 0 {
+		return fmt.Errorf("rate limit of %s must be positive", name)
+	}
+	if limit.Window <= 0 {
+		limit.Window = 1
+	}
+	if limit.Key == "" {
+		limit.Key = RATE_LIMIT_KEY_IP
+	}
+	if limit.Key != RATE_LIMIT_KEY_IP && limit.Key != RATE_LIMIT_KEY_API_KEY && !strings.HasPrefix(limit.Key, RATE_LIMIT_KEY_HEADER) {
+		return fmt.Errorf("unknown rate limit key: %s", limit.Key)
+	}
+	return nil
+}
+
+// rateLimit returns the limit of the route, the route's own one takes precedence
+func (route Route) rateLimit(site *HttpServer) *RateLimitOptions {
+	limit := site.RateLimit
+	if route.RateLimit != nil {
+		limit = route.RateLimit
+	}
+	if limit == nil || limit.Disabled {
+		return nil
+	}
+	return limit
+}
+
+// clientKey tells the client of the request apart
+func (limit *RateLimitOptions) clientKey(r *http.Request, auth *AuthOptions) string {
+	switch {
+	case limit.Key == RATE_LIMIT_KEY_API_KEY:
+		header, query := DEFAULT_API_KEY_HEADER, ""
+		if auth != nil {
+			if auth.ApiKeyHeader != "" {
+				header = auth.ApiKeyHeader
+			}
+			query = auth.ApiKeyQuery
+		}
+		if key := r.Header.Get(header); key != "" || query == "" {
+			return key
+		}
+		return r.URL.Query().Get(query)
+	case strings.HasPrefix(limit.Key, RATE_LIMIT_KEY_HEADER):
+		return r.Header.Get(strings.TrimPrefix(limit.Key, RATE_LIMIT_KEY_HEADER))
+	default:
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	}
+}
+
+// take takes one request from the counter of the key, the state after it is returned
+func (limit *RateLimitOptions) take(key string, now time.Time) (allowed bool, status RateLimitStatus, retryAfter int64) {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+
+	counter, ok := limit.counters[key]
+	if !ok {
+		counter = &rateCounter{tokens: float64(limit.Limit), last: now}
+		limit.counters[key] = counter
+	}
+
+	limit.refill(counter, now)
+	if limit.Algorithm == RATE_LIMIT_FIXED_WINDOW {
+		if counter.count < limit.Limit {
+			counter.count++
+			allowed = true
+		}
+	} else if counter.tokens >= 1 {
+		counter.tokens--
+		allowed = true
+	}
+
+	status = limit.status(counter, now)
+	if !allowed {
+		retryAfter = status.Reset
+		if limit.Algorithm == RATE_LIMIT_TOKEN_BUCKET {
+			// one token is enough
+			retryAfter = ceilSeconds((1 - counter.tokens) / limit.rate())
+		}
+	}
+	return
+}
+
+// refill refills the bucket by the time passed, or starts a new window
+func (limit *RateLimitOptions) refill(counter *rateCounter, now time.Time) {
+	if limit.Algorithm == RATE_LIMIT_FIXED_WINDOW {
+		if now.Sub(counter.last) >= limit.window() {
+			counter.count, counter.last = 0, now
+		}
+		return
+	}
+
+	counter.tokens = math.Min(float64(limit.Limit), counter.tokens+now.Sub(counter.last).Seconds()*limit.rate())
+	counter.last = now
+}
+
+func (limit *RateLimitOptions) status(counter *rateCounter, now time.Time) RateLimitStatus {
+	if limit.Algorithm == RATE_LIMIT_FIXED_WINDOW {
+		return RateLimitStatus{
+			Remaining: limit.Limit - counter.count,
+			Reset:     ceilSeconds(counter.last.Add(limit.window()).Sub(now).Seconds()),
+		}
+	}
+
+	// the bucket is reset when it's full again
+	return RateLimitStatus{
+		Remaining: int64(counter.tokens),
+		Reset:     ceilSeconds((float64(limit.Limit) - counter.tokens) / limit.rate()),
+	}
+}
+
+func (limit *RateLimitOptions) window() time.Duration {
+	return time.Duration(limit.Window) * time.Second
+}
+
+// rate returns the tokens refilled per second
+func (limit *RateLimitOptions) rate() float64 {
+	return float64(limit.Limit) / float64(limit.Window)
+}
+
+func ceilSeconds(seconds float64) int64 {
+	if seconds <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(seconds))
+}
+
+// allow checks the limit of the request, a 429 is responded if it's exceeded
+func (limit *RateLimitOptions) allow(w http.ResponseWriter, r *http.Request, auth *AuthOptions) bool {
+	allowed, status, retryAfter := limit.take(limit.clientKey(r, auth), time.Now())
+
+	header := w.Header()
+	header.Set("X-RateLimit-Limit", strconv.FormatInt(limit.Limit, 10))
+	header.Set("X-RateLimit-Remaining", strconv.FormatInt(status.Remaining, 10))
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(status.Reset, 10))
+	if allowed {
+		return true
+	}
+
+	header.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	writeJson(w, http.StatusTooManyRequests, map[string]string{"error": "rate limit exceeded"})
+	return false
+}
+
+// info returns the state of every counter
+func (limit *RateLimitOptions) info(now time.Time) RateLimitInfo {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+
+	info := RateLimitInfo{
+		Name:      limit.name,
+		Algorithm: limit.Algorithm,
+		Limit:     limit.Limit,
+		Window:    limit.Window,
+		Key:       limit.Key,
+		Counters:  make(map[string]RateLimitStatus, len(limit.counters)),
+	}
+	for key, counter := range limit.counters {
+		limit.refill(counter, now)
+		info.Counters[key] = limit.status(counter, now)
+	}
+	return info
+}
+
+// reset drops the counter of the key, or all of them if the key is empty
+func (limit *RateLimitOptions) reset(key string) {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+
+	if key == "" {
+		limit.counters = make(map[string]*rateCounter)
+	} else {
+		delete(limit.counters, key)
+	}
+}
+
+// rateLimits returns every limit of the server, the shared ones only once
+func (server *HttpServer) rateLimits() []*RateLimitOptions {
+	sites := []*HttpServer{server}
+	for _, vhost := range server.Hosts {
+		sites = append(sites, vhost)
+	}
+
+	limits := make([]*RateLimitOptions, 0)
+	seen := make(map[*RateLimitOptions]bool)
+	add := func(limit *RateLimitOptions) {
+		if limit != nil && !limit.Disabled && !seen[limit] {
+			seen[limit] = true
+			limits = append(limits, limit)
+		}
+	}
+	for _, site := range sites {
+		add(site.RateLimit)
+		for _, route := range site.StaticRoutes {
+			add(route.RateLimit)
+		}
+	}
+
+	sort.Slice(limits, func(i, j int) bool { return limits[i].name < limits[j].name })
+	return limits
+}
+
+// serveRateLimitAdmin shows the counters, or resets them by DELETE with the optional name and key
+func (server *HttpServer) serveRateLimitAdmin(w http.ResponseWriter, r *http.Request) {
+	name, key := r.URL.Query().Get("name"), r.URL.Query().Get("key")
+
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		infos := make([]RateLimitInfo, 0)
+		for _, limit := range server.rateLimits() {
+			infos = append(infos, limit.info(now))
+		}
+		writeJson(w, http.StatusOK, infos)
+	case http.MethodDelete, http.MethodPost:
+		for _, limit := range server.rateLimits() {
+			if name == "" || name == limit.name {
+				limit.reset(key)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,157 @@
+package conf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTake(t *testing.T) {
+	type step struct {
+		after      time.Duration
+		allowed    bool
+		remaining  int64
+		retryAfter int64
+	}
+
+	tests := []struct {
+		name  string
+		limit *RateLimitOptions
+		steps []step
+	}{
+		{
+			name:  "token bucket",
+			limit: &RateLimitOptions{Limit: 2, Window: 1},
+			steps: []step{
+				{0, true, 1, 0},
+				{0, true, 0, 0},
+				{0, false, 0, 1},
+				{500 * time.Millisecond, true, 0, 0},
+				{0, false, 0, 1},
+				// the bucket doesn't grow over the limit
+				{time.Minute, true, 1, 0},
+			},
+		},
+		{
+			name:  "slow refill",
+			limit: &RateLimitOptions{Limit: 1, Window: 10},
+			steps: []step{
+				{0, true, 0, 0},
+				{2 * time.Second, false, 0, 8},
+				{8 * time.Second, true, 0, 0},
+			},
+		},
+		{
+			name:  "fixed window",
+			limit: &RateLimitOptions{Algorithm: RATE_LIMIT_FIXED_WINDOW, Limit: 2, Window: 10},
+			steps: []step{
+				{0, true, 1, 0},
+				{time.Second, true, 0, 0},
+				{time.Second, false, 0, 8},
+				{7 * time.Second, false, 0, 1},
+				{time.Second, true, 1, 0},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := tt.limit
+			if err := limit.compile(tt.name); err != nil {
+				t.Fatal(err)
+			}
+
+			now := time.Now()
+			for i, s := range tt.steps {
+				now = now.Add(s.after)
+				allowed, status, retryAfter := limit.take("client", now)
+				if allowed != s.allowed || status.Remaining != s.remaining || retryAfter != s.retryAfter {
+					t.Errorf("step %d: allowed = %v, remaining = %d, retry after = %d, want %v, %d, %d",
+						i+1, allowed, status.Remaining, retryAfter, s.allowed, s.remaining, s.retryAfter)
+				}
+			}
+
+			// the other clients have their own counters
+			if allowed, _, _ := limit.take("other", now); !allowed {
+				t.Error("another client is limited")
+			}
+		})
+	}
+}
+
+func TestRateLimitAllow(t *testing.T) {
+	limit := &RateLimitOptions{Algorithm: RATE_LIMIT_FIXED_WINDOW, Limit: 1, Window: 60}
+	if err := limit.compile("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		code       int
+		remaining  string
+		retryAfter string
+	}{
+		{"allowed", http.StatusOK, "0", ""},
+		{"exceeded", http.StatusTooManyRequests, "0", "60"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if limit.allow(w, httptest.NewRequest("GET", "/", nil), nil) {
+				w.WriteHeader(http.StatusOK)
+			}
+
+			header := w.Header()
+			if w.Code != tt.code {
+				t.Errorf("code = %d, want %d", w.Code, tt.code)
+			}
+			if got := header.Get("X-RateLimit-Limit"); got != "1" {
+				t.Errorf("X-RateLimit-Limit = %q", got)
+			}
+			if got := header.Get("X-RateLimit-Remaining"); got != tt.remaining {
+				t.Errorf("X-RateLimit-Remaining = %q, want %q", got, tt.remaining)
+			}
+			if got := header.Get("X-RateLimit-Reset"); got == "" {
+				t.Error("X-RateLimit-Reset is missing")
+			}
+			if got := header.Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestRateLimitClientKey(t *testing.T) {
+	auth := &AuthOptions{ApiKeyHeader: "X-Key", ApiKeyQuery: "key"}
+
+	tests := []struct {
+		name   string
+		key    string
+		auth   *AuthOptions
+		target string
+		header map[string]string
+		want   string
+	}{
+		{"ip", RATE_LIMIT_KEY_IP, nil, "/", nil, "192.0.2.1"},
+		{"api key header", RATE_LIMIT_KEY_API_KEY, auth, "/", map[string]string{"X-Key": "k1"}, "k1"},
+		{"api key query", RATE_LIMIT_KEY_API_KEY, auth, "/?key=k2", nil, "k2"},
+		{"default api key header", RATE_LIMIT_KEY_API_KEY, nil, "/", map[string]string{DEFAULT_API_KEY_HEADER: "k3"}, "k3"},
+		{"header", RATE_LIMIT_KEY_HEADER + "X-Tenant", nil, "/", map[string]string{"X-Tenant": "acme"}, "acme"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+
+			limit := &RateLimitOptions{Key: tt.key}
+			if got := limit.clientKey(r, tt.auth); got != tt.want {
+				t.Errorf("key = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package conf
+
+import (
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	FORMAT_RAW = "raw"
+)
+
+// matchRawDir matches the files under the directory of a raw route, the returned route
+// points to the requested file
+func (route Route) matchRawDir(urlPath string) (Route, bool) {
+	if !route.Raw || route.Path == "/" && urlPath == "/" {
+		return route, false
+	}
+
+	rest, ok := strings.CutPrefix(urlPath, strings.TrimSuffix(route.Path, "/")+"/")
+	if !ok {
+		return route, false
+	}
+
+	// the cleaned path never goes above the directory
+	route.File = filepath.Join(route.File, filepath.FromSlash(path.Clean("/"+rest)))
+	route.dirRequest = strings.HasSuffix(urlPath, "/")
+	return route, true
+}
+
+// ServRaw serves the file byte-for-byte, with range requests and conditional requests supported,
+// and the directory listing if it's enabled
+func (route Route) ServRaw(w http.ResponseWriter, r *http.Request, values url.Values) {
+	file, err := os.Open(route.File)
+	if err != nil {
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if info.IsDir() {
+		if !route.Listing {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		route.serveListing(w, file)
+		return
+	}
+	if route.dirRequest {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// ServeContent handles If-None-Match and If-Range with the etag set in advance
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func (route Route) serveListing(w http.ResponseWriter, dir *os.File) {
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintln(w, "<pre>")
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", (&url.URL{Path: name}).String(), html.EscapeString(name))
+	}
+	fmt.Fprintln(w, "</pre>")
+}
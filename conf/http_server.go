@@ -2,23 +2,37 @@ package conf
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/zddava/goext/enum"
 	"github.com/zddava/gowrap/consul"
 	"github.com/zddava/gowrap/json"
 	"golang.org/x/exp/slices"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -28,10 +42,19 @@ const (
 	KEY_CONSUL_API_BASE     = "consul_api_base"
 	KEY_CONSUL_SERVICE_NAME = "consul_service_name"
 	KEY_CONSUL_SERVICE_HOST = "consul_service_host"
+	KEY_OPENAPI             = "openapi"
+	KEY_OPENAPI_VALIDATE    = "openapi_validate"
+	KEY_HEALTH_PATH         = "health_path"
+	KEY_READY_PATH          = "ready_path"
+	KEY_HEALTH_STATUS       = "health_status"
+	KEY_HOST                = "host"
+	KEY_H2C                 = "h2c"
 
 	DEFAULT_HTTP_PORT    = 8080
 	DEFAULT_DYNAMIC_POST = true
 	DEFAULT_HTTP_ROOT    = "http-server-root"
+	DEFAULT_HEALTH_PATH  = "/health"
+	DEFAULT_READY_PATH   = "/ready"
 
 	CONTENT_TYPE_CHARSET  = "charset="
 	CONTENT_TYPE_BOUNDARY = "boundary="
@@ -44,13 +67,47 @@ const (
 
 type (
 	HttpServer struct {
-		Port              int16
+		ConfigFile        string
+		Port              int
 		DynamicRoute      bool
 		DBRoot            string
 		ConsulApiBase     string
 		ConsulServiceName string
 		ConsulServiceHost string
+		TlsCert           string
+		TlsKey            string
+		TlsAuto           bool
+		TlsHosts          []string
+		TlsCaOut          string
+		ClientCa          string
+		ClientAuth        string
+		H2C               bool
+		OpenApi           string
+		OpenApiValidate   bool
+		HealthPath        string
+		ReadyPath         string
+		MetricsPath       string
+		Log               *LogOptions
+		Trace             *TraceOptions
+		Cors              *CorsOptions
+		Auth              *AuthOptions
+		OAuth             *OAuthOptions
+		RateLimit         *RateLimitOptions
 		StaticRoutes      RouteMap
+		Hosts             map[string]*HttpServer
+
+		logger    *slog.Logger
+		tracer    *tracer
+		unhealthy atomic.Bool
+		ready     atomic.Bool
+		tlsConfig *tls.Config
+		// the dir of the embedded server, which the relative paths are relative to
+		dir string
+		// parsed only to be checked, e.g. by validate, no file is written and no key is generated
+		dryRun bool
+		server *http.Server
+		cancel context.CancelFunc
+		done   chan struct{}
 	}
 
 	RouteMap    map[string]Route
@@ -67,20 +124,52 @@ type (
 		Fields        []string
 		UniqueNotList bool
 		Resolver      HttpFileResolver
+		// the resolver of the response, negotiated by the Accept header
+		ReplyResolver HttpFileResolver
+		Segments      []string
+		RequestSchema *OpenApiSchema
+		ReplySchema   *OpenApiSchema
+		ClientSubject []string
+		Protocol      string
+		Script        *WebSocketScript
+		Sse           *SseOptions
+		Stream        string
+		StreamDelay   int64
+		Raw           bool
+		Listing       bool
+		Cors          *CorsOptions
+		Auth          *AuthOptions
+		RateLimit     *RateLimitOptions
+		// the canned responses, which take precedence over the data file
+		Stubs []*RouteStub
+
+		dirRequest bool
+		// served by the dynamic route, the path is not a route
+		dynamic bool
 	}
 
 	RouteInfoMap map[string]RouteInfo
 
 	RouteInfo struct {
-		Path          string   `toml:"path,omitempty"`
-		Method        string   `toml:"method,omitempty"`
-		Action        string   `toml:"action,omitempty"`
-		Format        string   `toml:"format,omitempty"`
-		File          string   `toml:"file,omitempty"`
-		Single        bool     `toml:"single,omitempty"`
-		Id            []string `toml:"id,omitempty"`
-		Fields        []string `toml:"fields,omitempty"`
-		UniqueNotList bool     `toml:"unique_not_list,omitempty"`
+		Path          string            `toml:"path,omitempty"`
+		Method        string            `toml:"method,omitempty"`
+		Action        string            `toml:"action,omitempty"`
+		Format        string            `toml:"format,omitempty"`
+		File          string            `toml:"file,omitempty"`
+		Single        bool              `toml:"single,omitempty"`
+		Id            []string          `toml:"id,omitempty"`
+		Fields        []string          `toml:"fields,omitempty"`
+		UniqueNotList bool              `toml:"unique_not_list,omitempty"`
+		ClientSubject []string          `toml:"client_subject,omitempty"`
+		Protocol      string            `toml:"protocol,omitempty"`
+		Script        *WebSocketScript  `toml:"script,omitempty"`
+		Sse           *SseOptions       `toml:"sse,omitempty"`
+		Stream        string            `toml:"stream,omitempty"`
+		StreamDelay   int64             `toml:"stream_delay,omitzero"`
+		Listing       bool              `toml:"listing,omitempty"`
+		Cors          *CorsOptions      `toml:"cors,omitempty"`
+		Auth          *AuthOptions      `toml:"auth,omitempty"`
+		RateLimit     *RateLimitOptions `toml:"rate_limit,omitempty"`
 	}
 
 	HttpFileModel struct {
@@ -127,8 +216,16 @@ var (
 	JsonResolver = JsonFileResolver{}
 	YamlResolver = YamlFileResolver{}
 
+	// other names of the yaml mime type seen in the wild
+	MIME_TYPE_YAML_ALIASES = []string{"application/x-yaml", "text/yaml", "text/x-yaml"}
+
+	// fileLocks serializes the read-modify-write of the data files, by the requests and the websocket messages
+	fileLocks sync.Map
+
 	MimeTypeMap = make(map[string]HttpFileType)
 	FileExtMap  = make(map[string]HttpFileType)
+	// FileTypes keeps the registration order, the first one is preferred
+	FileTypes = make([]HttpFileType, 0)
 )
 
 func (resolver JsonFileResolver) Marshal(v any) ([]byte, error) {
@@ -143,14 +240,25 @@ func (resolver JsonFileResolver) ContentType() string {
 	return MIME_TYPE_JSON
 }
 
+// the yaml resolver goes through json, so that the json tags of the models are respected
+
 func (resolver YamlFileResolver) Marshal(v any) ([]byte, error) {
-	// TODO
-	return nil, nil
+	var generic any
+	if err := json.Convert(&generic, v); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
 }
 
 func (resolver YamlFileResolver) Unmarshal(data []byte, v any) error {
-	// TODO
-	return nil
+	var generic any
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return err
+	}
+	if generic == nil {
+		return nil
+	}
+	return json.Convert(v, normalizeYaml(generic))
 }
 
 func (resolver YamlFileResolver) ContentType() string {
@@ -163,6 +271,10 @@ func init() {
 
 	MimeTypeMap[MIME_TYPE_JSON] = jsonType
 	MimeTypeMap[MIME_TYPE_YAML] = ymlType
+	for _, alias := range MIME_TYPE_YAML_ALIASES {
+		MimeTypeMap[alias] = ymlType
+	}
+	FileTypes = append(FileTypes, jsonType, ymlType)
 
 	for _, ext := range FILE_EXT_JSON {
 		FileExtMap[ext] = jsonType
@@ -179,6 +291,11 @@ func (ri *RouteInfo) resolve(root string) (key string, route Route, err error) {
 	}
 	route.Path = ri.Path
 
+	// path template, e.g. /orders/{id}
+	if strings.Contains(ri.Path, "{") {
+		route.Segments = strings.Split(strings.TrimPrefix(ri.Path, "/"), "/")
+	}
+
 	// method
 	ri.Method = strings.ToUpper(ri.Method)
 	if ri.Method == "" {
@@ -202,26 +319,31 @@ func (ri *RouteInfo) resolve(root string) (key string, route Route, err error) {
 		route.File = filepath.Join(root, ri.File)
 	} else {
 		var dbfile string
-		if filepath.Ext(ri.Path) == "" {
-			if strings.HasSuffix(ri.Path, "/") {
-				ri.Path = ri.Path + "index"
+		path := trimPathVariables(ri.Path)
+		if filepath.Ext(path) == "" {
+			if strings.HasSuffix(path, "/") {
+				path = path + "index"
 			}
 
-			if ri.Format == "" {
-				dbfile = ri.Path + DEFAULT_FILE_EXT
+			if strings.EqualFold(ri.Format, FORMAT_RAW) {
+				dbfile = path
+			} else if ri.Format == "" {
+				dbfile = path + DEFAULT_FILE_EXT
 			} else {
-				dbfile = ri.Path + "." + ri.Format
+				dbfile = path + "." + ri.Format
 			}
 		} else {
-			dbfile = ri.Path
+			dbfile = path
 		}
 
 		route.File = filepath.Join(root, dbfile)
 	}
 
-	// resolver
+	// resolver, raw files don't need one
 	ext, set := strings.ToLower(filepath.Ext(route.File)), false
-	if ext == "" {
+	if strings.EqualFold(ri.Format, FORMAT_RAW) {
+		set, route.Raw = true, true
+	} else if ext == "" {
 		if ri.Format == "" {
 			set = true
 			route.Resolver = JsonResolver
@@ -235,11 +357,15 @@ func (ri *RouteInfo) resolve(root string) (key string, route Route, err error) {
 	if !set {
 		if r, ok := FileExtMap[ext]; ok {
 			route.Resolver = r.Resolver
+		} else if ri.Format == "" && route.Method == HTTP_METHOD_GET && mime.TypeByExtension("."+ext) != "" {
+			// not a data file but a known type, e.g. pdf, only read as it is
+			route.Raw = true
 		} else {
 			err = fmt.Errorf("unknown file format: %s", ext)
 			return
 		}
 	}
+	route.Listing = ri.Listing
 
 	// single
 	route.Single = ri.Single
@@ -253,9 +379,153 @@ func (ri *RouteInfo) resolve(root string) (key string, route Route, err error) {
 	// UniqueNotList
 	route.UniqueNotList = ri.UniqueNotList
 
+	// client certificate
+	route.ClientSubject = ri.ClientSubject
+
+	// cors, overrides the one of the site
+	route.Cors = ri.Cors
+
+	// auth, overrides the one of the site
+	route.Auth = ri.Auth
+	if route.Auth != nil {
+		if err = route.Auth.compile(); err != nil {
+			return
+		}
+	}
+
+	// rate limit, with its own counters
+	route.RateLimit = ri.RateLimit
+	if route.RateLimit != nil {
+		if err = route.RateLimit.compile(key); err != nil {
+			return
+		}
+	}
+
+	// stream
+	switch ri.Stream {
+	case "", STREAM_NDJSON, STREAM_JSON_SEQ:
+		route.Stream = ri.Stream
+		route.StreamDelay = ri.StreamDelay
+	default:
+		err = fmt.Errorf("unknown stream format: %s", ri.Stream)
+		return
+	}
+
+	// protocol
+	switch strings.ToLower(ri.Protocol) {
+	case "", PROTOCOL_HTTP:
+	case PROTOCOL_WEBSOCKET:
+		route.Protocol = PROTOCOL_WEBSOCKET
+		route.Script = ri.Script
+		if route.Script != nil {
+			if err = route.Script.compile(); err != nil {
+				return
+			}
+		}
+	case PROTOCOL_SSE:
+		route.Protocol = PROTOCOL_SSE
+		route.Sse = ri.Sse
+	default:
+		err = fmt.Errorf("unknown protocol: %s", ri.Protocol)
+		return
+	}
+
 	return
 }
 
+// trimPathVariables removes the {var} segments of a path template, so that
+// /orders and /orders/{id} share the same data file
+func trimPathVariables(path string) string {
+	if !strings.Contains(path, "{") {
+		return path
+	}
+
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(path, "/") {
+		if !strings.HasPrefix(segment, "{") {
+			segments = append(segments, segment)
+		}
+	}
+
+	trimmed := strings.Join(segments, "/")
+	if trimmed == "" {
+		return "/"
+	}
+	return trimmed
+}
+
+// matchTemplate matches the request path against the path template of the route,
+// returns the path variables and the count of literal segments
+func (route Route) matchTemplate(path string) (vars map[string]string, literals int, ok bool) {
+	paths := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(paths) != len(route.Segments) {
+		return nil, 0, false
+	}
+
+	vars = make(map[string]string)
+	for i, segment := range route.Segments {
+		if isPathVariable(segment) {
+			if paths[i] == "" {
+				return nil, 0, false
+			}
+			vars[segment[1:len(segment)-1]] = paths[i]
+		} else if segment == paths[i] {
+			literals++
+		} else {
+			return nil, 0, false
+		}
+	}
+
+	return vars, literals, true
+}
+
+func isPathVariable(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
+
+// moreSpecific breaks the tie of two templates with the same count of literal segments,
+// the one with the leftmost literal segment wins, e.g. /orders/{id} over /{kind}/latest
+func (route Route) moreSpecific(other Route) bool {
+	for i := 0; i < len(route.Segments) && i < len(other.Segments); i++ {
+		if v, ov := isPathVariable(route.Segments[i]), isPathVariable(other.Segments[i]); v != ov {
+			return !v
+		}
+	}
+	return route.Path < other.Path
+}
+
+// checkTemplates rejects the templates that match the same paths equally, e.g. /orders/{id} and /orders/{no}
+func (config *HttpServer) checkTemplates() error {
+	keys := make([]string, 0, len(config.StaticRoutes))
+	for key := range config.StaticRoutes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	shapes := make(map[string]string)
+	for _, key := range keys {
+		route := config.StaticRoutes[key]
+		if len(route.Segments) == 0 {
+			continue
+		}
+
+		segments := make([]string, len(route.Segments))
+		for i, segment := range route.Segments {
+			if isPathVariable(segment) {
+				segment = "{}"
+			}
+			segments[i] = segment
+		}
+
+		shape := strings.Join(segments, "/") + "_" + strings.TrimPrefix(key, route.Path+"_")
+		if other, ok := shapes[shape]; ok {
+			return fmt.Errorf("ambiguous route paths: %s and %s", other, route.Path)
+		}
+		shapes[shape] = route.Path
+	}
+	return nil
+}
+
 func (method *HTTP_METHOD) defaultAction() *HTTP_ACTION {
 	switch method {
 	case HTTP_METHOD_GET:
@@ -271,92 +541,409 @@ func (method *HTTP_METHOD) defaultAction() *HTTP_ACTION {
 	return HTTP_ACTION_READ
 }
 
-func parseHttpServer(configPath string) (*HttpServer, error) {
-	config := &HttpServer{
+// newHttpServer returns a server with the default properties
+func newHttpServer(configPath string, dir string) *HttpServer {
+	return &HttpServer{
+		ConfigFile:   configPath,
 		Port:         DEFAULT_HTTP_PORT,
 		DynamicRoute: DEFAULT_DYNAMIC_POST,
 		DBRoot:       DEFAULT_HTTP_ROOT,
+		HealthPath:   DEFAULT_HEALTH_PATH,
+		ReadyPath:    DEFAULT_READY_PATH,
+		MetricsPath:  DEFAULT_METRICS_PATH,
+		Log:          &LogOptions{},
+		StaticRoutes: make(RouteMap),
+		dir:          dir,
 	}
+}
+
+// parseHttpServer parses the config file, the dry run doesn't write the generated ca and data files
+func parseHttpServer(configPath string, dryRun bool) (*HttpServer, error) {
+	config := newHttpServer(configPath, "")
+	config.dryRun = dryRun
 
 	if !FileExists(configPath) {
 		if !FileExists(DEFAULT_HTTP_ROOT) {
 			return nil, nil
 		}
-		return config, nil
+		var err error
+		config.logger, err = config.Log.newLogger()
+		return config, err
 	}
 
-	var m map[string]any
-	_, err := toml.DecodeFile(configPath, &m)
+	overrides, err := configOverrides(configPath)
 	if err != nil {
 		return nil, err
 	}
+	if err := config.parse(overrides); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// LoadHttpServer loads the server to embed, the config file and the relative paths in it are relative to dir
+// if it's not empty, the server has the default properties if there is no config file
+func LoadHttpServer(dir string, configPath string) (*HttpServer, error) {
+	if dir != "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		dir = abs
+	}
+
+	config := newHttpServer(configPath, dir)
+	if configPath == "" {
+		config.DBRoot = config.path(config.DBRoot)
+		var err error
+		config.logger, err = config.Log.newLogger()
+		return config, err
+	}
+
+	config.ConfigFile = config.path(configPath)
+	if err := config.parse(nil); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// path resolves a path of the config against the dir of the server
+func (config *HttpServer) path(p string) string {
+	if config.dir == "" || p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(config.dir, p)
+}
+
+// parse parses the config file and the included ones, the top level properties are replaced by the overrides
+func (config *HttpServer) parse(overrides map[string]any) error {
+	m, err := loadConfig(config.ConfigFile)
+	if err != nil {
+		return err
+	}
+	for key, value := range overrides {
+		m[key] = value
+	}
+
+	if logOpts, ok := m[KEY_LOG]; ok {
+		if err := decodeSection(logOpts, config.Log); err != nil {
+			return err
+		}
+		delete(m, KEY_LOG)
+	}
+	if config.logger, err = config.Log.newLogger(); err != nil {
+		return err
+	}
+
+	if trace, ok := m[KEY_TRACE]; ok {
+		config.Trace = &TraceOptions{}
+		if err := decodeSection(trace, config.Trace); err != nil {
+			return err
+		}
+		if config.tracer, err = config.Trace.newTracer(); err != nil {
+			return err
+		}
+		delete(m, KEY_TRACE)
+	}
 
 	// parse generic properties
 	if port, ok := m[KEY_HTTP_PORT]; ok {
-		config.Port = int16(port.(int64))
+		p, ok := port.(int64)
+		if !ok || p < 1 || p > 65535 {
+			return fmt.Errorf("invalid port: %v", port)
+		}
+		config.Port = int(p)
 		delete(m, KEY_HTTP_PORT)
 	}
-	if dynamicPost, ok := m[KEY_DYNAMIC_ROUTE]; ok {
-		config.DynamicRoute = dynamicPost.(bool)
-		delete(m, KEY_DYNAMIC_ROUTE)
-	}
-	if dbRoot, ok := m[KEY_HTTP_ROOT]; ok {
-		config.DBRoot = dbRoot.(string)
-		delete(m, KEY_HTTP_ROOT)
-	}
 	if apiBase, ok := m[KEY_CONSUL_API_BASE]; ok {
-		config.ConsulApiBase = apiBase.(string)
+		if config.ConsulApiBase, ok = apiBase.(string); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_CONSUL_API_BASE, apiBase)
+		}
 		delete(m, KEY_CONSUL_API_BASE)
 	}
 	if serviceName, ok := m[KEY_CONSUL_SERVICE_NAME]; ok {
-		config.ConsulServiceName = serviceName.(string)
+		if config.ConsulServiceName, ok = serviceName.(string); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_CONSUL_SERVICE_NAME, serviceName)
+		}
 		delete(m, KEY_CONSUL_SERVICE_NAME)
 	}
 	if serviceHost, ok := m[KEY_CONSUL_SERVICE_HOST]; ok {
-		config.ConsulServiceHost = serviceHost.(string)
+		if config.ConsulServiceHost, ok = serviceHost.(string); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_CONSUL_SERVICE_HOST, serviceHost)
+		}
 		delete(m, KEY_CONSUL_SERVICE_HOST)
 	}
 
-	// parse static routes
-	if len(m) == 0 {
-		return config, nil
+	if healthPath, ok := m[KEY_HEALTH_PATH]; ok {
+		if config.HealthPath, ok = healthPath.(string); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_HEALTH_PATH, healthPath)
+		}
+		delete(m, KEY_HEALTH_PATH)
+	}
+	if readyPath, ok := m[KEY_READY_PATH]; ok {
+		if config.ReadyPath, ok = readyPath.(string); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_READY_PATH, readyPath)
+		}
+		delete(m, KEY_READY_PATH)
+	}
+	if metricsPath, ok := m[KEY_METRICS_PATH]; ok {
+		if config.MetricsPath, ok = metricsPath.(string); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_METRICS_PATH, metricsPath)
+		}
+		delete(m, KEY_METRICS_PATH)
+	}
+	if healthStatus, ok := m[KEY_HEALTH_STATUS]; ok {
+		status, ok := healthStatus.(string)
+		if !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_HEALTH_STATUS, healthStatus)
+		}
+		config.unhealthy.Store(strings.EqualFold(status, HEALTH_STATUS_DOWN))
+		delete(m, KEY_HEALTH_STATUS)
 	}
 
-	buf := new(bytes.Buffer)
-	err = toml.NewEncoder(buf).Encode(m)
-	if err != nil {
-		return nil, err
+	if h2c, ok := m[KEY_H2C]; ok {
+		if config.H2C, ok = h2c.(bool); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_H2C, h2c)
+		}
+		delete(m, KEY_H2C)
 	}
 
-	var rim RouteInfoMap
+	if err := config.parseTls(m); err != nil {
+		return err
+	}
 
-	_, err = toml.NewDecoder(buf).Decode(&rim)
-	if err != nil {
-		return nil, err
+	if oauth, ok := m[KEY_OAUTH]; ok {
+		config.OAuth = &OAuthOptions{}
+		if err := decodeSection(oauth, config.OAuth); err != nil {
+			return err
+		}
+		if err := config.OAuth.compile(config.dryRun); err != nil {
+			return err
+		}
+		delete(m, KEY_OAUTH)
 	}
 
-	if len(rim) == 0 {
-		return config, nil
+	// virtual hosts, parsed after the default site which they inherit from
+	hosts, _ := m[KEY_HOST].(map[string]any)
+	delete(m, KEY_HOST)
+
+	if err := config.parseSite(m); err != nil {
+		return err
+	}
+
+	if len(hosts) > 0 {
+		config.Hosts = make(map[string]*HttpServer)
+		for name, host := range hosts {
+			hm, ok := host.(map[string]any)
+			if !ok {
+				return fmt.Errorf("invalid host: %s", name)
+			}
+
+			vhost := &HttpServer{
+				dir:             config.dir,
+				dryRun:          config.dryRun,
+				DynamicRoute:    config.DynamicRoute,
+				DBRoot:          filepath.Join(config.DBRoot, name),
+				OpenApiValidate: config.OpenApiValidate,
+				Cors:            config.Cors,
+				Auth:            config.Auth,
+				RateLimit:       config.RateLimit,
+			}
+			if err := vhost.parseSite(hm); err != nil {
+				return fmt.Errorf("host %s: %w", name, err)
+			}
+			for _, limit := range vhost.rateLimits() {
+				if limit != config.RateLimit {
+					limit.name = name + " " + limit.name
+				}
+			}
+			config.Hosts[strings.ToLower(name)] = vhost
+		}
+	}
+
+	if err := config.linkOAuth(); err != nil {
+		return err
+	}
+
+	if err := config.buildTls(); err != nil {
+		return err
+	}
+	if err := config.checkConsul(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// parseSite parses the properties of a site, i.e. the default one or a virtual host, and its static routes
+func (config *HttpServer) parseSite(m map[string]any) error {
+	if dynamicPost, ok := m[KEY_DYNAMIC_ROUTE]; ok {
+		if config.DynamicRoute, ok = dynamicPost.(bool); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_DYNAMIC_ROUTE, dynamicPost)
+		}
+		delete(m, KEY_DYNAMIC_ROUTE)
+	}
+	if dbRoot, ok := m[KEY_HTTP_ROOT]; ok {
+		if config.DBRoot, ok = dbRoot.(string); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_HTTP_ROOT, dbRoot)
+		}
+		delete(m, KEY_HTTP_ROOT)
+	}
+	config.DBRoot = config.path(config.DBRoot)
+	if spec, ok := m[KEY_OPENAPI]; ok {
+		p, ok := spec.(string)
+		if !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_OPENAPI, spec)
+		}
+		config.OpenApi = config.path(p)
+		delete(m, KEY_OPENAPI)
+	}
+	if validate, ok := m[KEY_OPENAPI_VALIDATE]; ok {
+		if config.OpenApiValidate, ok = validate.(bool); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_OPENAPI_VALIDATE, validate)
+		}
+		delete(m, KEY_OPENAPI_VALIDATE)
+	}
+	if cors, ok := m[KEY_CORS]; ok {
+		config.Cors = &CorsOptions{}
+		if err := decodeSection(cors, config.Cors); err != nil {
+			return err
+		}
+		delete(m, KEY_CORS)
+	}
+	if auth, ok := m[KEY_AUTH]; ok {
+		config.Auth = &AuthOptions{}
+		if err := decodeSection(auth, config.Auth); err != nil {
+			return err
+		}
+		if err := config.Auth.compile(); err != nil {
+			return err
+		}
+		delete(m, KEY_AUTH)
+	}
+	if limit, ok := m[KEY_RATE_LIMIT]; ok {
+		config.RateLimit = &RateLimitOptions{}
+		if err := decodeSection(limit, config.RateLimit); err != nil {
+			return err
+		}
+		if err := config.RateLimit.compile(RATE_LIMIT_GLOBAL); err != nil {
+			return err
+		}
+		delete(m, KEY_RATE_LIMIT)
 	}
 
+	// parse static routes
 	config.StaticRoutes = make(RouteMap)
-	for _, ri := range rim {
-		key, route, err := ri.resolve(config.DBRoot)
+	if len(m) > 0 {
+		buf := new(bytes.Buffer)
+		err := toml.NewEncoder(buf).Encode(m)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		if _, ok := config.StaticRoutes[key]; ok {
-			return nil, fmt.Errorf("duplicate route path: %s", ri.Path)
+		var rim RouteInfoMap
+
+		_, err = toml.NewDecoder(buf).Decode(&rim)
+		if err != nil {
+			return err
 		}
 
-		config.StaticRoutes[key] = route
+		for _, ri := range rim {
+			key, route, err := ri.resolve(config.DBRoot)
+			if err != nil {
+				return err
+			}
+
+			if _, ok := config.StaticRoutes[key]; ok {
+				return fmt.Errorf("duplicate route path: %s", ri.Path)
+			}
+
+			config.StaticRoutes[key] = route
+		}
 	}
 
-	return config, nil
+	// routes generated from openapi, static routes take precedence
+	if config.OpenApi != "" {
+		if err := config.loadOpenApi(); err != nil {
+			return err
+		}
+	}
+
+	return config.checkTemplates()
+}
+
+// decodeSection decodes a section of the config into the struct by its toml tags
+func decodeSection(section any, v any) error {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(section); err != nil {
+		return err
+	}
+
+	_, err := toml.NewDecoder(buf).Decode(v)
+	return err
+}
+
+// site returns the virtual host of the request host, or the server itself as the default one
+func (server *HttpServer) site(host string) *HttpServer {
+	if len(server.Hosts) == 0 {
+		return server
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	if vhost, ok := server.Hosts[host]; ok {
+		return vhost
+	}
+
+	// wildcard, e.g. *.payments.local
+	for dot := strings.Index(host, "."); dot >= 0; dot = strings.Index(host, ".") {
+		host = host[dot+1:]
+		if vhost, ok := server.Hosts["*."+host]; ok {
+			return vhost
+		}
+	}
+
+	return server
 }
 
 func (route Route) ServHTTP(w http.ResponseWriter, r *http.Request, values url.Values) {
+	if len(route.Stubs) > 0 && route.ServStub(w, r, values) {
+		return
+	}
+
+	if route.Raw {
+		route.ServRaw(w, r, values)
+		return
+	}
+
+	switch route.Protocol {
+	case PROTOCOL_WEBSOCKET:
+		route.ServWebSocket(w, r, values)
+		return
+	case PROTOCOL_SSE:
+		route.ServSse(w, r, values)
+		return
+	}
+
+	// the streamed lists have their own formats
+	route.ReplyResolver = route.Resolver
+	if route.Stream == "" || route.Single || route.Action != HTTP_ACTION_READ {
+		var acceptable bool
+		if route.ReplyResolver, acceptable = negotiate(r.Header.Get("Accept"), route.Resolver); !acceptable {
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	if route.RequestSchema != nil && (route.Method == HTTP_METHOD_POST || route.Method == HTTP_METHOD_PUT) {
+		if !route.validateRequest(w, r) {
+			return
+		}
+	}
+
 	switch route.Action {
 	case HTTP_ACTION_READ:
 		route.ServRead(w, r, values)
@@ -369,8 +956,16 @@ func (route Route) ServHTTP(w http.ResponseWriter, r *http.Request, values url.V
 	}
 }
 
-func (route Route) WriteResponse(w http.ResponseWriter, data any) bool {
-	if bytes, err := route.Resolver.Marshal(data); err == nil {
+func (route Route) WriteResponse(w http.ResponseWriter, r *http.Request, data any) bool {
+	data = fillClaims(r, data)
+
+	if route.ReplySchema != nil {
+		if errs := route.ReplySchema.Validate(data); len(errs) > 0 {
+			log.Printf("response of %s %s does not match openapi: %s", route.Method.Code, route.Path, strings.Join(errs, "; "))
+		}
+	}
+
+	if bytes, err := route.ReplyResolver.Marshal(data); err == nil {
 		w.Write(bytes)
 		return true
 	} else {
@@ -379,6 +974,17 @@ func (route Route) WriteResponse(w http.ResponseWriter, data any) bool {
 	}
 }
 
+// valueString formats the value of a datum field for comparison with query values
+func valueString(value reflect.Value) string {
+	if value.Kind() == reflect.Interface || value.Kind() == reflect.Pointer {
+		value = value.Elem()
+	}
+	if !value.IsValid() || value.Kind() == reflect.String {
+		return value.String()
+	}
+	return fmt.Sprint(value.Interface())
+}
+
 func (route Route) matchQuery(data []any, values url.Values) []any {
 	if len(values) == 0 {
 		return data
@@ -395,10 +1001,7 @@ func (route Route) matchQuery(data []any, values url.Values) []any {
 		for key, value := range values {
 			mapValue := datumValue.MapIndex(reflect.ValueOf(key))
 			for _, val := range value {
-				if mapValue.Kind() == reflect.Interface || mapValue.Kind() == reflect.Pointer {
-					mapValue = mapValue.Elem()
-				}
-				if mapValue.String() == val {
+				if valueString(mapValue) == val {
 					count++
 					break
 				}
@@ -453,6 +1056,7 @@ func (route Route) ServRead(w http.ResponseWriter, r *http.Request, values url.V
 	bytes, err := os.ReadFile(route.File)
 	if err != nil {
 		log.Println(err)
+		metrics.fileError(route.File, FILE_OP_READ)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -460,26 +1064,48 @@ func (route Route) ServRead(w http.ResponseWriter, r *http.Request, values url.V
 	model := HttpFileModel{}
 	if err := route.Resolver.Unmarshal(bytes, &model); err != nil {
 		log.Println(err)
+		metrics.fileError(route.File, FILE_OP_READ)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	metrics.items(route.File, len(model.Data))
 
-	w.Header().Set("Content-Type", route.Resolver.ContentType())
+	if route.Stream != "" && !route.Single {
+		route.ServStream(w, r, route.project(route.matchQuery(model.Data, values)))
+		return
+	}
+
+	w.Header().Set("Content-Type", route.ReplyResolver.ContentType())
 
 	if route.Single {
-		route.WriteResponse(w, model.Datum)
+		route.WriteResponse(w, r, model.Datum)
 	} else {
 		list := route.project(route.matchQuery(model.Data, values))
 		if route.UniqueNotList && len(list) == 1 {
-			route.WriteResponse(w, list[0])
+			route.WriteResponse(w, r, list[0])
 		} else {
-			route.WriteResponse(w, list)
+			route.WriteResponse(w, r, list)
 		}
 
 	}
 }
 
+// lockFile locks the data file for a read-modify-write, the returned func unlocks it
+func (route Route) lockFile() func() {
+	lock, _ := fileLocks.LoadOrStore(route.File, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
 func (route Route) readModel() (model HttpFileModel, err error) {
+	defer func() {
+		if err != nil {
+			metrics.fileError(route.File, FILE_OP_READ)
+		} else {
+			metrics.items(route.File, len(model.Data))
+		}
+	}()
+
 	created := false
 	if !FileExists(route.File) {
 		if _, err = os.Create(route.File); err != nil {
@@ -505,39 +1131,45 @@ func (route Route) readModel() (model HttpFileModel, err error) {
 	return
 }
 
-func (route Route) doWriteOrAppendData(w http.ResponseWriter, model *HttpFileModel) {
+func (route Route) doWriteOrAppendData(w http.ResponseWriter, r *http.Request, model *HttpFileModel) bool {
 	bytes, err := route.Resolver.Marshal(model)
 	if err != nil {
 		log.Println(err)
+		metrics.fileError(route.File, FILE_OP_WRITE)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return false
 	}
 
 	if err := os.WriteFile(route.File, bytes, 0666); err != nil {
 		log.Println(err)
+		metrics.fileError(route.File, FILE_OP_WRITE)
 		w.WriteHeader(http.StatusInternalServerError)
-		return
+		return false
 	}
+	metrics.items(route.File, len(model.Data))
 
-	w.Header().Set("Content-Type", route.Resolver.ContentType())
+	w.Header().Set("Content-Type", route.ReplyResolver.ContentType())
 
 	if route.Action == HTTP_ACTION_DELETE {
 		if len(model.DelResponse) > 0 {
-			route.WriteResponse(w, model.DelResponse)
+			route.WriteResponse(w, r, model.DelResponse)
 		} else {
-			route.WriteResponse(w, DEFAULT_RESPONSE)
+			route.WriteResponse(w, r, DEFAULT_RESPONSE)
 		}
 	} else {
 		if len(model.PostResponse) > 0 {
-			route.WriteResponse(w, model.PostResponse)
+			route.WriteResponse(w, r, model.PostResponse)
 		} else {
-			route.WriteResponse(w, DEFAULT_RESPONSE)
+			route.WriteResponse(w, r, DEFAULT_RESPONSE)
 		}
 	}
 
+	return true
 }
 
 func (route Route) ServWrite(w http.ResponseWriter, r *http.Request, values url.Values) {
+	defer route.lockFile()()
+
 	model, err := route.readModel()
 	if err != nil {
 		log.Println(err)
@@ -576,10 +1208,12 @@ func (route Route) ServWrite(w http.ResponseWriter, r *http.Request, values url.
 		}
 	}
 
-	route.doWriteOrAppendData(w, &model)
+	route.doWriteOrAppendData(w, r, &model)
 }
 
 func (route Route) ServAppend(w http.ResponseWriter, r *http.Request, values url.Values) {
+	defer route.lockFile()()
+
 	model, err := route.readModel()
 	if err != nil {
 		log.Println(err)
@@ -615,8 +1249,8 @@ func (route Route) ServAppend(w http.ResponseWriter, r *http.Request, values url
 		}
 	}
 
-	// check if unique
-	if len(route.Id) > 0 {
+	// check if unique, the items without the id don't conflict
+	if len(route.Id) > 0 && hasId(newDatum, route.Id) {
 		for _, datum := range model.Data {
 			datumValue := reflect.ValueOf(datum)
 			if datumValue.Kind() != reflect.Map {
@@ -626,11 +1260,7 @@ func (route Route) ServAppend(w http.ResponseWriter, r *http.Request, values url
 			unique := false
 			for _, key := range route.Id {
 				mapValue := datumValue.MapIndex(reflect.ValueOf(key))
-				if mapValue.Kind() == reflect.Interface || mapValue.Kind() == reflect.Pointer {
-					mapValue = mapValue.Elem()
-				}
-
-				if mapValue.String() != newDatum[key] {
+				if valueString(mapValue) != valueString(reflect.ValueOf(newDatum[key])) {
 					unique = true
 					break
 				}
@@ -644,10 +1274,24 @@ func (route Route) ServAppend(w http.ResponseWriter, r *http.Request, values url
 
 	model.Data = append(model.Data, newDatum)
 
-	route.doWriteOrAppendData(w, &model)
+	if route.doWriteOrAppendData(w, r, &model) {
+		hub.publish(route.File, newDatum)
+	}
+}
+
+// hasId checks whether the datum has every id field
+func hasId(datum map[string]any, id []string) bool {
+	for _, key := range id {
+		if _, ok := datum[key]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
 func (route Route) ServDelete(w http.ResponseWriter, r *http.Request, values url.Values) {
+	defer route.lockFile()()
+
 	model, err := route.readModel()
 	if err != nil {
 		log.Println(err)
@@ -656,9 +1300,9 @@ func (route Route) ServDelete(w http.ResponseWriter, r *http.Request, values url
 
 	if len(values) == 0 {
 		if len(model.PostResponse) > 0 {
-			route.WriteResponse(w, model.DelResponse)
+			route.WriteResponse(w, r, model.DelResponse)
 		} else {
-			route.WriteResponse(w, DEFAULT_RESPONSE)
+			route.WriteResponse(w, r, DEFAULT_RESPONSE)
 		}
 		return
 	}
@@ -675,12 +1319,8 @@ func (route Route) ServDelete(w http.ResponseWriter, r *http.Request, values url
 		count := 0
 		for key, value := range values {
 			mapValue := datumValue.MapIndex(reflect.ValueOf(key))
-			if mapValue.Kind() == reflect.Interface || mapValue.Kind() == reflect.Pointer {
-				mapValue = mapValue.Elem()
-			}
-
 			for _, val := range value {
-				if mapValue.String() == val {
+				if valueString(mapValue) == val {
 					count++
 					break
 				}
@@ -693,7 +1333,7 @@ func (route Route) ServDelete(w http.ResponseWriter, r *http.Request, values url
 	}
 
 	model.Data = remaining
-	route.doWriteOrAppendData(w, &model)
+	route.doWriteOrAppendData(w, r, &model)
 
 }
 
@@ -718,6 +1358,39 @@ func (server *HttpServer) staticRouteMatch(r *http.Request) (route Route, values
 		return
 	}
 
+	// handle path template, the one with more literal segments wins
+	best := -1
+	var bestVars map[string]string
+	for _, candidate := range server.StaticRoutes {
+		if len(candidate.Segments) == 0 || candidate.Method == nil || candidate.Method.Code != r.Method {
+			continue
+		}
+		vars, literals, matched := candidate.matchTemplate(r.URL.Path)
+		if matched && (literals > best || (literals == best && candidate.moreSpecific(route))) {
+			best, bestVars, route = literals, vars, candidate
+		}
+	}
+	if best >= 0 {
+		for k, v := range bestVars {
+			values.Add(k, v)
+		}
+		return route, values, true
+	}
+
+	// handle the files under the directory of raw routes, the longest path wins
+	matched := false
+	for _, candidate := range server.StaticRoutes {
+		if candidate.Method == nil || candidate.Method.Code != r.Method || (matched && len(candidate.Path) <= len(route.Path)) {
+			continue
+		}
+		if dirRoute, ok := candidate.matchRawDir(r.URL.Path); ok {
+			route, matched = dirRoute, true
+		}
+	}
+	if matched {
+		return route, values, true
+	}
+
 	if strings.HasSuffix(r.URL.Path, "/") {
 		return route, values, false
 	}
@@ -762,17 +1435,56 @@ func (server *HttpServer) staticRouteMatch(r *http.Request) (route Route, values
 }
 
 func (server *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("uri: %s, method: %s", r.RequestURI, r.Method)
+	rec, start := &responseRecorder{ResponseWriter: w, labels: requestLabels{port: server.Port}}, time.Now()
+	reader := server.Log.capture(rec, r)
+
+	var span *traceSpan
+	if server.Trace != nil {
+		span = startSpan(r)
+		rec.traceId = span.traceId
+		if server.Trace.Echo {
+			span.echo(w, r)
+		}
+	}
+
+	defer func() {
+		duration := time.Since(start)
+		metrics.observe(rec, duration)
+		server.logRequest(rec, r, reader, duration)
+		if server.tracer != nil && span.sampled {
+			server.tracer.add(span.end(rec, r))
+		}
+	}()
+	w = rec
+
+	site := server.site(r.Host)
+
+	// the preflight is answered with the cors options of the route it asks for
+	if isPreflight(r) {
+		cors := site.Cors
+		if route, ok := site.preflightRoute(r); ok {
+			cors = route.cors(site)
+		}
+		if cors != nil {
+			cors.servePreflight(w, r)
+			return
+		}
+	}
+	site.Cors.writeCors(w, r)
+
+	if server.serveHealth(w, r) || server.serveMetrics(w, r) || server.serveAdmin(w, r) || server.serveOAuth(w, r) {
+		return
+	}
 
 	var route Route
 	var ok bool
 	var values url.Values
 
-	if route, values, ok = server.staticRouteMatch(r); !ok {
-		if server.DynamicRoute {
+	if route, values, ok = site.staticRouteMatch(r); !ok {
+		if site.DynamicRoute {
 			mimeType := _parseContentType(r)
 
-			route = Route{Path: r.URL.Path}
+			route = Route{Path: r.URL.Path, dynamic: true}
 			route.Method = enum.ParseEnum[HTTP_METHOD](r.Method)
 			if route.Method == nil {
 				w.WriteHeader(http.StatusMethodNotAllowed)
@@ -780,22 +1492,43 @@ func (server *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 
 			route.Action = route.Method.defaultAction()
-			if ft, ok := MimeTypeMap[mimeType]; ok {
-				route.Resolver = ft.Resolver
-			} else {
-				w.WriteHeader(http.StatusUnsupportedMediaType)
+
+			// not a data file, e.g. pdf, served as it is
+			ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(r.URL.Path)), ".")
+			if _, known := FileExtMap[ext]; ext != "" && !known && route.Method == HTTP_METHOD_GET {
+				route.Raw = true
+				route.File = filepath.Join(site.DBRoot, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+				rec.record(route)
+				route.ServHTTP(w, r, r.URL.Query())
 				return
 			}
 
-			if filepath.Ext(r.URL.Path) == "" {
-				if ft, found := MimeTypeMap[mimeType]; found {
-					route.File = filepath.Join(server.DBRoot, r.URL.Path+ft.DefaultFileExt)
-				} else {
+			ft, found := MimeTypeMap[mimeType]
+			if !found {
+				// reads don't have a body, the format is decided by the file
+				if route.Method != HTTP_METHOD_GET {
 					w.WriteHeader(http.StatusUnsupportedMediaType)
 					return
 				}
+				ft = FileTypes[0]
+			}
+			route.Resolver = ft.Resolver
+
+			if ext == "" {
+				route.File = filepath.Join(site.DBRoot, r.URL.Path+ft.DefaultFileExt)
 			} else {
-				route.File = filepath.Join(server.DBRoot, r.URL.Path)
+				route.File = filepath.Join(site.DBRoot, r.URL.Path)
+			}
+
+			// reads find the file whatever extension it uses, and read it in its own format
+			if route.Method == HTTP_METHOD_GET {
+				if ext == "" {
+					if file, fileType, located := locateFile(filepath.Join(site.DBRoot, r.URL.Path)); located {
+						route.File, route.Resolver = file, fileType.Resolver
+					}
+				} else if fileType, known := FileExtMap[ext]; known {
+					route.Resolver = fileType.Resolver
+				}
 			}
 
 			route.Id = []string{"id"}
@@ -808,15 +1541,77 @@ func (server *HttpServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	fmt.Println(route, values)
+	rec.record(route)
+
+	if len(route.ClientSubject) > 0 && !route.matchClient(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if route.Cors != nil {
+		route.Cors.writeCors(w, r)
+	}
+
+	if auth := route.auth(site); auth != nil {
+		claims, err := auth.authenticate(r)
+		if err != nil {
+			server.logger.Debug("auth failed", "route", rec.labels.route, "error", err.Error())
+			auth.challenge(w, err)
+			writeJson(w, err.code, map[string]string{"error": err.message})
+			return
+		}
+		values = auth.claimValues(auth.withoutApiKey(values), claims)
+		r = withClaims(r, claims)
+	}
+
+	if limit := route.rateLimit(site); limit != nil && !limit.allow(w, r, route.auth(site)) {
+		return
+	}
 
 	route.ServHTTP(w, r, values)
 }
 
-func (server *HttpServer) Listen() {
-	log.Printf("http server config: %v", server)
+func (server *HttpServer) Listen() error {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(server.Port))
+	if err != nil {
+		return fmt.Errorf("http server listen error: %w", err)
+	}
+	server.Serve(ln)
+	return nil
+}
+
+// Serve serves on the listener in the background until the server is stopped,
+// the port of the server becomes the one of the listener, e.g. when it's listening on :0
+func (server *HttpServer) Serve(ln net.Listener) {
+	if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+		server.Port = addr.Port
+	}
+	server.server = &http.Server{Addr: ":" + strconv.Itoa(server.Port), Handler: server, TLSConfig: server.tlsConfig}
+
+	// canceled on stop, so that the streaming routes end before shutdown waits for them
+	ctx, cancel := context.WithCancel(context.Background())
+	server.server.BaseContext = func(net.Listener) context.Context { return ctx }
+	server.cancel = cancel
+
+	// cleartext http/2, both with prior knowledge and upgrade, the http2 server is registered
+	// to the http server as well, so that shutdown sends GOAWAY to the h2c connections
+	if server.H2C && server.tlsConfig == nil {
+		h2s := &http2.Server{}
+		if err := http2.ConfigureServer(server.server, h2s); err != nil {
+			log.Printf("http2 config error: %s", err.Error())
+		} else {
+			server.server.Handler = h2c.NewHandler(server, h2s)
+		}
+	}
+	server.done = make(chan struct{})
+
+	if server.tracer != nil {
+		server.tracer.start()
+	}
 
 	go func() {
+		defer close(server.done)
+
 		var consulClient *consul.ConsulClient
 		var consulInstanceId string
 		if server.ConsulApiBase != "" && server.ConsulServiceName != "" {
@@ -826,15 +1621,90 @@ func (server *HttpServer) Listen() {
 			if serviceHost == "" {
 				serviceHost = "127.0.0.1"
 			}
-			consulClient.Register(server.ConsulServiceName, consulInstanceId, "/health", serviceHost, int(server.Port), nil, nil)
+			if err := server.registerConsul(consulClient, consulInstanceId, serviceHost); err != nil {
+				log.Println(err)
+			}
 		}
 
-		http.ListenAndServe(":"+strconv.FormatInt(int64(server.Port), 10), server)
+		server.ready.Store(true)
+		var err error
+		if server.tlsConfig != nil {
+			err = server.server.ServeTLS(ln, "", "")
+		} else {
+			err = server.server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("http server error: %s", err.Error())
+		}
 
 		if server.ConsulApiBase != "" && server.ConsulServiceName != "" {
 			consulClient.Deregister(consulInstanceId)
 		}
 	}()
 
-	log.Printf("http server listen on :%d", server.Port)
+	if server.tlsConfig != nil {
+		log.Printf("https server listen on :%d", server.Port)
+	} else if server.H2C {
+		log.Printf("http server listen on :%d with h2c", server.Port)
+	} else {
+		log.Printf("http server listen on :%d", server.Port)
+	}
+}
+
+// TLS returns whether the server serves https
+func (server *HttpServer) TLS() bool {
+	return server.tlsConfig != nil
+}
+
+// AddRoute adds a static route to the default site, it must be called before the server starts serving
+func (server *HttpServer) AddRoute(ri RouteInfo) error {
+	key, route, err := ri.resolve(server.DBRoot)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := server.StaticRoutes[key]; ok {
+		return fmt.Errorf("duplicate route path: %s", ri.Path)
+	}
+
+	server.StaticRoutes[key] = route
+	if err := server.checkTemplates(); err != nil {
+		delete(server.StaticRoutes, key)
+		return err
+	}
+	return nil
+}
+
+// Summary describes the server in one line for the startup summary
+func (server *HttpServer) Summary() string {
+	return fmt.Sprintf("http  :%-5d  db_root=%s  routes=%d  hosts=%d  dynamic_route=%v  conf=%s",
+		server.Port, server.DBRoot, len(server.StaticRoutes), len(server.Hosts), server.DynamicRoute, server.ConfigFile)
+}
+
+// Stop waits for the in-flight requests, and their data file writes, to finish,
+// then deregisters from consul
+func (server *HttpServer) Stop(ctx context.Context) error {
+	if server.server == nil {
+		return nil
+	}
+
+	server.ready.Store(false)
+	server.cancel()
+	err := server.server.Shutdown(ctx)
+
+	select {
+	case <-server.done:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	// the spans of the requests served are exported before stop returns
+	if server.tracer != nil {
+		err = errors.Join(err, server.tracer.stop(ctx))
+	}
+
+	log.Printf("http server on :%d stopped", server.Port)
+	return err
 }
@@ -0,0 +1,208 @@
+package conf
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PROTOCOL_SSE = "sse"
+
+	MIME_TYPE_EVENT_STREAM = "text/event-stream"
+
+	SSE_BUFFER = 64
+)
+
+type (
+	// SseOptions describes how a sse route streams the items of its data file
+	SseOptions struct {
+		// milliseconds between the events, 0 means all at once
+		Interval int64 `toml:"interval,omitempty"`
+		// event name, the default is message
+		Event string `toml:"event,omitempty"`
+		// the field of the item used as the event id, it's also used to resume from Last-Event-ID
+		IdField string `toml:"id_field,omitempty"`
+		// reconnection time in milliseconds sent to the client
+		Retry int64 `toml:"retry,omitempty"`
+		// start over when all the items are sent
+		Loop bool `toml:"loop,omitempty"`
+		// keep the stream open and send the items appended to the data file by other routes
+		Broadcast bool `toml:"broadcast,omitempty"`
+	}
+
+	// dataHub broadcasts the items appended to the data files
+	dataHub struct {
+		mutex       sync.Mutex
+		subscribers map[string]map[chan any]struct{}
+	}
+)
+
+var (
+	hub = &dataHub{subscribers: make(map[string]map[chan any]struct{})}
+)
+
+func (hub *dataHub) subscribe(file string) chan any {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	ch := make(chan any, SSE_BUFFER)
+	if _, ok := hub.subscribers[file]; !ok {
+		hub.subscribers[file] = make(map[chan any]struct{})
+	}
+	hub.subscribers[file][ch] = struct{}{}
+	return ch
+}
+
+func (hub *dataHub) unsubscribe(file string, ch chan any) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	delete(hub.subscribers[file], ch)
+	if len(hub.subscribers[file]) == 0 {
+		delete(hub.subscribers, file)
+	}
+}
+
+// publish sends the items to the subscribers of the file, slow subscribers miss them
+func (hub *dataHub) publish(file string, items ...any) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for ch := range hub.subscribers[file] {
+		for _, item := range items {
+			select {
+			case ch <- item:
+			default:
+				log.Printf("sse subscriber of %s is too slow, item dropped", file)
+			}
+		}
+	}
+}
+
+// writeEvent writes the item as a server-sent event
+func (route Route) writeEvent(w http.ResponseWriter, item any) error {
+	opts := route.Sse
+
+	bytes, err := route.Resolver.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	var event strings.Builder
+	if opts.IdField != "" {
+		if m, ok := item.(map[string]any); ok {
+			if id, ok := m[opts.IdField]; ok {
+				fmt.Fprintf(&event, "id: %s\n", valueString(reflect.ValueOf(id)))
+			}
+		}
+	}
+	if opts.Event != "" {
+		fmt.Fprintf(&event, "event: %s\n", opts.Event)
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(bytes), "\n"), "\n") {
+		fmt.Fprintf(&event, "data: %s\n", line)
+	}
+	event.WriteString("\n")
+
+	if _, err := w.Write([]byte(event.String())); err != nil {
+		return err
+	}
+	w.(http.Flusher).Flush()
+	return nil
+}
+
+// resume skips the items up to the one with the id of Last-Event-ID
+func (route Route) resume(items []any, lastEventId string) []any {
+	if lastEventId == "" || route.Sse.IdField == "" {
+		return items
+	}
+
+	for i, item := range items {
+		if m, ok := item.(map[string]any); ok && valueString(reflect.ValueOf(m[route.Sse.IdField])) == lastEventId {
+			return items[i+1:]
+		}
+	}
+	return items
+}
+
+func (route Route) ServSse(w http.ResponseWriter, r *http.Request, values url.Values) {
+	if _, ok := w.(http.Flusher); !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if route.Sse == nil {
+		route.Sse = &SseOptions{}
+	}
+	opts := route.Sse
+
+	// subscribe before reading, so no item appended in between is missed
+	var appended chan any
+	if opts.Broadcast {
+		appended = hub.subscribe(route.File)
+		defer hub.unsubscribe(route.File, appended)
+	}
+
+	model, err := route.readModel()
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	all := route.project(route.matchQuery(model.Data, values))
+	items := route.resume(all, r.Header.Get("Last-Event-ID"))
+
+	w.Header().Set("Content-Type", MIME_TYPE_EVENT_STREAM)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if opts.Retry > 0 {
+		fmt.Fprintf(w, "retry: %d\n\n", opts.Retry)
+	}
+	w.(http.Flusher).Flush()
+
+	var tick <-chan time.Time
+	if opts.Interval > 0 {
+		ticker := time.NewTicker(time.Duration(opts.Interval) * time.Millisecond)
+		defer ticker.Stop()
+		tick = ticker.C
+	} else {
+		for _, item := range items {
+			if err := route.writeEvent(w, item); err != nil {
+				return
+			}
+		}
+		items = nil
+	}
+
+	for {
+		if len(items) == 0 && opts.Loop && opts.Interval > 0 {
+			items = all
+		}
+		if len(items) == 0 && !opts.Broadcast {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick:
+			if len(items) > 0 {
+				if err := route.writeEvent(w, items[0]); err != nil {
+					return
+				}
+				items = items[1:]
+			}
+		case item := <-appended:
+			for _, matched := range route.project(route.matchQuery([]any{item}, values)) {
+				if err := route.writeEvent(w, matched); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package conf
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	STREAM_NDJSON   = "ndjson"
+	STREAM_JSON_SEQ = "json-seq"
+
+	MIME_TYPE_NDJSON   = "application/x-ndjson"
+	MIME_TYPE_JSON_SEQ = "application/json-seq"
+
+	// record separator of json text sequences, RFC 7464
+	JSON_SEQ_RS = 0x1E
+)
+
+// ServStream writes the items one record at a time in chunks, flushing after each one,
+// with the delay of the route in between
+func (route Route) ServStream(w http.ResponseWriter, r *http.Request, list []any) {
+	flusher, _ := w.(http.Flusher)
+
+	if route.Stream == STREAM_JSON_SEQ {
+		w.Header().Set("Content-Type", MIME_TYPE_JSON_SEQ)
+	} else {
+		w.Header().Set("Content-Type", MIME_TYPE_NDJSON)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	for i, item := range list {
+		if i > 0 && route.StreamDelay > 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(time.Duration(route.StreamDelay) * time.Millisecond):
+			}
+		}
+
+		bytes, err := JsonResolver.Marshal(item)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		record := make([]byte, 0, len(bytes)+2)
+		if route.Stream == STREAM_JSON_SEQ {
+			record = append(record, JSON_SEQ_RS)
+		}
+		record = append(append(record, bytes...), '\n')
+
+		if _, err := w.Write(record); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package conf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+type (
+	// RouteStub is a canned response of a static route, it's used instead of the data file
+	// for the requests it matches, e.g. the stubs built by package server
+	RouteStub struct {
+		// matches the request, the values are the query and the path variables, nil matches every request
+		Match  func(r *http.Request, values url.Values, body []byte) bool
+		Status int
+		Header http.Header
+		Body   []byte
+		// the most times it's used, 0 is unlimited
+		Times int
+		Delay time.Duration
+
+		mutex sync.Mutex
+		calls int
+		// the matched requests after it's used up
+		overflow int
+	}
+)
+
+// Calls returns how many requests the stub responded
+func (stub *RouteStub) Calls() int {
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+	return stub.calls
+}
+
+// Overflow returns how many requests the stub matched after it's used up, they are not responded by it
+func (stub *RouteStub) Overflow() int {
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+	return stub.overflow
+}
+
+// take counts the request if the stub matches it and is not used up
+func (stub *RouteStub) take(r *http.Request, values url.Values, body []byte) bool {
+	if stub.Match != nil && !stub.Match(r, values, body) {
+		return false
+	}
+
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+
+	if stub.Times > 0 && stub.calls >= stub.Times {
+		stub.overflow++
+		return false
+	}
+	stub.calls++
+	return true
+}
+
+// AddStub adds the stub to the static route of the default site, the route is added if there is none,
+// it must be called before the server starts serving
+func (server *HttpServer) AddStub(ri RouteInfo, stub *RouteStub) error {
+	key, route, err := ri.resolve(server.DBRoot)
+	if err != nil {
+		return err
+	}
+	if route.Method == nil {
+		return fmt.Errorf("unsupported method: %s, one of GET, POST, PUT, DELETE", ri.Method)
+	}
+
+	existing, ok := server.StaticRoutes[key]
+	if ok {
+		existing.Stubs = append(existing.Stubs, stub)
+		server.StaticRoutes[key] = existing
+		return nil
+	}
+
+	route.Stubs = []*RouteStub{stub}
+	server.StaticRoutes[key] = route
+	if err := server.checkTemplates(); err != nil {
+		delete(server.StaticRoutes, key)
+		return err
+	}
+	return nil
+}
+
+// ServStub responds with the first stub that matches the request, returns false if there is none,
+// the request body is kept for the data file then
+func (route Route) ServStub(w http.ResponseWriter, r *http.Request, values url.Values) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadRequest)
+		return true
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	for _, stub := range route.Stubs {
+		if !stub.take(r, values, body) {
+			continue
+		}
+
+		if stub.Delay > 0 {
+			select {
+			case <-time.After(stub.Delay):
+			case <-r.Context().Done():
+				return true
+			}
+		}
+
+		for name, vs := range stub.Header {
+			for _, v := range vs {
+				w.Header().Add(name, v)
+			}
+		}
+
+		status := stub.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		w.Write(stub.Body)
+		return true
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return false
+}
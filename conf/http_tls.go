@@ -0,0 +1,259 @@
+package conf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	KEY_TLS_CERT    = "tls_cert"
+	KEY_TLS_KEY     = "tls_key"
+	KEY_TLS_AUTO    = "tls_auto"
+	KEY_TLS_HOSTS   = "tls_hosts"
+	KEY_TLS_CA_OUT  = "tls_ca_out"
+	KEY_CLIENT_CA   = "client_ca"
+	KEY_CLIENT_AUTH = "client_auth"
+
+	DEFAULT_TLS_CA_OUT = "smock-ca.pem"
+
+	CLIENT_AUTH_REQUIRE  = "require"
+	CLIENT_AUTH_OPTIONAL = "optional"
+
+	TLS_CERT_VALIDITY = 365 * 24 * time.Hour
+)
+
+// parseTls parses the tls properties
+func (config *HttpServer) parseTls(m map[string]any) error {
+	if cert, ok := m[KEY_TLS_CERT]; ok {
+		p, ok := cert.(string)
+		if !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_TLS_CERT, cert)
+		}
+		config.TlsCert = config.path(p)
+		delete(m, KEY_TLS_CERT)
+	}
+	if key, ok := m[KEY_TLS_KEY]; ok {
+		p, ok := key.(string)
+		if !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_TLS_KEY, key)
+		}
+		config.TlsKey = config.path(p)
+		delete(m, KEY_TLS_KEY)
+	}
+	if auto, ok := m[KEY_TLS_AUTO]; ok {
+		if config.TlsAuto, ok = auto.(bool); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_TLS_AUTO, auto)
+		}
+		delete(m, KEY_TLS_AUTO)
+	}
+	if hosts, ok := m[KEY_TLS_HOSTS]; ok {
+		list, ok := hosts.([]any)
+		if !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_TLS_HOSTS, hosts)
+		}
+		for _, host := range list {
+			h, ok := host.(string)
+			if !ok {
+				return fmt.Errorf("invalid %s: %v", KEY_TLS_HOSTS, hosts)
+			}
+			config.TlsHosts = append(config.TlsHosts, h)
+		}
+		delete(m, KEY_TLS_HOSTS)
+	}
+	if caOut, ok := m[KEY_TLS_CA_OUT]; ok {
+		p, ok := caOut.(string)
+		if !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_TLS_CA_OUT, caOut)
+		}
+		config.TlsCaOut = config.path(p)
+		delete(m, KEY_TLS_CA_OUT)
+	}
+	if clientCa, ok := m[KEY_CLIENT_CA]; ok {
+		p, ok := clientCa.(string)
+		if !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_CLIENT_CA, clientCa)
+		}
+		config.ClientCa = config.path(p)
+		delete(m, KEY_CLIENT_CA)
+	}
+	if clientAuth, ok := m[KEY_CLIENT_AUTH]; ok {
+		if config.ClientAuth, ok = clientAuth.(string); !ok {
+			return fmt.Errorf("invalid %s: %v", KEY_CLIENT_AUTH, clientAuth)
+		}
+		delete(m, KEY_CLIENT_AUTH)
+	}
+	return nil
+}
+
+// buildTls builds the tls config if tls is enabled, after the virtual hosts are parsed
+func (config *HttpServer) buildTls() error {
+	if config.TlsCert == "" && !config.TlsAuto {
+		if config.ClientCa != "" {
+			return fmt.Errorf("%s requires %s/%s or %s", KEY_CLIENT_CA, KEY_TLS_CERT, KEY_TLS_KEY, KEY_TLS_AUTO)
+		}
+		return nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if config.TlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TlsCert, config.TlsKey)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else {
+		cert, err := config.generateCert()
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.ClientCa != "" {
+		pemBytes, err := os.ReadFile(config.ClientCa)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemBytes) {
+			return fmt.Errorf("no certificate found in %s", config.ClientCa)
+		}
+		tlsConfig.ClientCAs = pool
+
+		switch config.ClientAuth {
+		case "", CLIENT_AUTH_REQUIRE:
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		case CLIENT_AUTH_OPTIONAL:
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return fmt.Errorf("unknown %s: %s", KEY_CLIENT_AUTH, config.ClientAuth)
+		}
+	}
+
+	config.tlsConfig = tlsConfig
+	return nil
+}
+
+// generateCert generates a self-signed ca and a server certificate signed by it,
+// the ca is written to tls_ca_out for the clients to trust, unless it's a dry run
+func (config *HttpServer) generateCert() (tls.Certificate, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(now.UnixNano()),
+		Subject:               pkix.Name{CommonName: "smock ca", Organization: []string{"smock"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(TLS_CERT_VALIDITY),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano() + 1),
+		Subject:      pkix.Name{CommonName: "smock", Organization: []string{"smock"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(TLS_CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range config.certHosts() {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if config.dryRun {
+		return tls.Certificate{Certificate: [][]byte{der, caDer}, PrivateKey: key}, nil
+	}
+
+	caOut := config.TlsCaOut
+	if caOut == "" {
+		caOut = config.path(DEFAULT_TLS_CA_OUT)
+	}
+	if err := os.WriteFile(caOut, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}), 0644); err != nil {
+		return tls.Certificate{}, err
+	}
+	log.Printf("self-signed ca written to %s", caOut)
+
+	return tls.Certificate{Certificate: [][]byte{der, caDer}, PrivateKey: key}, nil
+}
+
+// certHosts returns the names of the generated certificate, the configured ones or localhost,
+// and the virtual hosts
+func (config *HttpServer) certHosts() []string {
+	hosts := append([]string{}, config.TlsHosts...)
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+		if config.ConsulServiceHost != "" {
+			hosts = append(hosts, config.ConsulServiceHost)
+		}
+	}
+
+	for name := range config.Hosts {
+		hosts = append(hosts, name)
+	}
+	return hosts
+}
+
+// clientSubject returns the subject of the verified client certificate
+func clientSubject(r *http.Request) *pkix.Name {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return &r.TLS.VerifiedChains[0][0].Subject
+}
+
+// matchClient checks the verified client certificate against the client_subject of the route,
+// by common name or the whole subject, e.g. CN=partner-a,O=partner
+func (route Route) matchClient(r *http.Request) bool {
+	subject := clientSubject(r)
+	if subject == nil {
+		return false
+	}
+
+	for _, expected := range route.ClientSubject {
+		if strings.EqualFold(expected, subject.CommonName) || strings.EqualFold(expected, subject.String()) {
+			return true
+		}
+	}
+	return false
+}
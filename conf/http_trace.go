@@ -0,0 +1,384 @@
+package conf
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zddava/gowrap/json"
+)
+
+const (
+	KEY_TRACE = "trace"
+
+	TRACE_EXPORTER_OTLP   = "otlp"
+	TRACE_EXPORTER_STDOUT = "stdout"
+
+	DEFAULT_OTLP_ENDPOINT      = "http://localhost:4318/v1/traces"
+	DEFAULT_TRACE_SERVICE_NAME = "smock"
+
+	HEADER_TRACEPARENT = "traceparent"
+	HEADER_TRACESTATE  = "tracestate"
+	HEADER_BAGGAGE     = "baggage"
+
+	TRACE_BATCH_SIZE     = 100
+	TRACE_QUEUE_SIZE     = 2048
+	TRACE_FLUSH_INTERVAL = time.Second
+	TRACE_EXPORT_TIMEOUT = 5 * time.Second
+
+	// the span kind and status codes of otlp
+	OTLP_SPAN_KIND_SERVER = 2
+	OTLP_STATUS_OK        = 1
+	OTLP_STATUS_ERROR     = 2
+)
+
+type (
+	// TraceOptions describes how the server spans are exported
+	TraceOptions struct {
+		// otlp, stdout, or empty to only propagate the context
+		Exporter string `toml:"exporter,omitempty"`
+		// the otlp/http traces endpoint, the default is http://localhost:4318/v1/traces
+		Endpoint string            `toml:"endpoint,omitempty"`
+		Headers  map[string]string `toml:"headers,omitempty"`
+		// the default is smock
+		ServiceName string `toml:"service_name,omitempty"`
+		// echo the trace headers in the responses, the ones of the server span if the request has none
+		Echo bool `toml:"echo,omitempty"`
+	}
+
+	// traceSpan is the server span of a request
+	traceSpan struct {
+		traceId      string
+		spanId       string
+		parentSpanId string
+		sampled      bool
+		start        time.Time
+		baggage      map[string]string
+	}
+
+	// tracer exports the spans in batches in the background
+	tracer struct {
+		opts   *TraceOptions
+		client *http.Client
+		mutex  sync.Mutex
+		closed bool
+		queue  chan otlpSpan
+		done   chan struct{}
+	}
+
+	otlpExport struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpSpan struct {
+		TraceId           string          `json:"traceId"`
+		SpanId            string          `json:"spanId"`
+		ParentSpanId      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes"`
+		Status            otlpStatus      `json:"status"`
+	}
+
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+
+	otlpStatus struct {
+		Code int `json:"code"`
+	}
+)
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validHex checks the id of the traceparent, all zeros is invalid
+func validHex(s string, n int) bool {
+	if len(s) != n*2 || strings.Trim(s, "0") == "" {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
+
+// startSpan starts the server span, as a child of the traceparent of the request if there is a valid one
+func startSpan(r *http.Request) *traceSpan {
+	span := &traceSpan{traceId: randomHex(16), spanId: randomHex(8), sampled: true, start: time.Now()}
+
+	// version-traceid-parentid-flags
+	parts := strings.Split(strings.TrimSpace(r.Header.Get(HEADER_TRACEPARENT)), "-")
+	if len(parts) >= 4 && len(parts[0]) == 2 && parts[0] != "ff" && validHex(parts[1], 16) && validHex(parts[2], 8) {
+		if flags, err := strconv.ParseUint(parts[3], 16, 8); err == nil {
+			span.traceId, span.parentSpanId, span.sampled = parts[1], parts[2], flags&1 == 1
+		}
+	}
+
+	span.baggage = parseBaggage(r.Header.Values(HEADER_BAGGAGE))
+	return span
+}
+
+// parseBaggage parses the baggage headers, the properties of the members are dropped
+func parseBaggage(headers []string) map[string]string {
+	baggage := make(map[string]string)
+	for _, header := range headers {
+		for _, member := range strings.Split(header, ",") {
+			member, _, _ = strings.Cut(member, ";")
+			key, value, ok := strings.Cut(member, "=")
+			if !ok {
+				continue
+			}
+			if unescaped, err := url.PathUnescape(strings.TrimSpace(value)); err == nil {
+				value = unescaped
+			}
+			baggage[strings.TrimSpace(key)] = value
+		}
+	}
+	return baggage
+}
+
+func (span *traceSpan) traceparent() string {
+	flags := "00"
+	if span.sampled {
+		flags = "01"
+	}
+	return "00-" + span.traceId + "-" + span.spanId + "-" + flags
+}
+
+// echo writes the trace headers of the request back, the server span's traceparent if the request has none
+func (span *traceSpan) echo(w http.ResponseWriter, r *http.Request) {
+	header := w.Header()
+	if traceparent := r.Header.Get(HEADER_TRACEPARENT); traceparent != "" {
+		header.Set(HEADER_TRACEPARENT, traceparent)
+	} else {
+		header.Set(HEADER_TRACEPARENT, span.traceparent())
+	}
+	if tracestate := r.Header.Get(HEADER_TRACESTATE); tracestate != "" {
+		header.Set(HEADER_TRACESTATE, tracestate)
+	}
+	for _, baggage := range r.Header.Values(HEADER_BAGGAGE) {
+		header.Add(HEADER_BAGGAGE, baggage)
+	}
+}
+
+// end ends the span with the response
+func (span *traceSpan) end(rec *responseRecorder, r *http.Request) otlpSpan {
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	name := r.Method
+	if rec.labels.route != "" {
+		name += " " + strings.TrimSuffix(rec.labels.route, "_"+r.Method)
+	}
+
+	attrs := []otlpAttribute{
+		stringAttribute("http.request.method", r.Method),
+		stringAttribute("url.path", r.URL.Path),
+		stringAttribute("server.address", r.Host),
+		stringAttribute("client.address", r.RemoteAddr),
+		intAttribute("http.response.status_code", int64(status)),
+		intAttribute("http.response.body.size", rec.bytes),
+	}
+	if rec.labels.route != "" {
+		attrs = append(attrs,
+			stringAttribute("http.route", strings.TrimSuffix(rec.labels.route, "_"+r.Method)),
+			stringAttribute("smock.route", rec.labels.route),
+			stringAttribute("smock.action", rec.labels.action),
+			stringAttribute("smock.format", rec.labels.format),
+			stringAttribute("smock.file", rec.file))
+	}
+	for key, value := range span.baggage {
+		attrs = append(attrs, stringAttribute("baggage."+key, value))
+	}
+
+	code := OTLP_STATUS_OK
+	if status >= http.StatusInternalServerError {
+		code = OTLP_STATUS_ERROR
+	}
+
+	return otlpSpan{
+		TraceId:           span.traceId,
+		SpanId:            span.spanId,
+		ParentSpanId:      span.parentSpanId,
+		Name:              name,
+		Kind:              OTLP_SPAN_KIND_SERVER,
+		StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		Attributes:        attrs,
+		Status:            otlpStatus{Code: code},
+	}
+}
+
+// newTracer checks the options, the tracer is nil if the spans are not exported
+func (opts *TraceOptions) newTracer() (*tracer, error) {
+	switch opts.Exporter {
+	case "":
+		return nil, nil
+	case TRACE_EXPORTER_OTLP:
+		if opts.Endpoint == "" {
+			opts.Endpoint = DEFAULT_OTLP_ENDPOINT
+		}
+	case TRACE_EXPORTER_STDOUT:
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", opts.Exporter)
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = DEFAULT_TRACE_SERVICE_NAME
+	}
+
+	return &tracer{
+		opts:   opts,
+		client: &http.Client{Timeout: TRACE_EXPORT_TIMEOUT},
+		queue:  make(chan otlpSpan, TRACE_QUEUE_SIZE),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// start exports the spans in the background until the tracer is stopped
+func (t *tracer) start() {
+	go func() {
+		defer close(t.done)
+
+		ticker := time.NewTicker(TRACE_FLUSH_INTERVAL)
+		defer ticker.Stop()
+
+		batch := make([]otlpSpan, 0, TRACE_BATCH_SIZE)
+		for {
+			select {
+			case span, ok := <-t.queue:
+				if !ok {
+					t.export(batch)
+					return
+				}
+				if batch = append(batch, span); len(batch) >= TRACE_BATCH_SIZE {
+					t.export(batch)
+					batch = batch[:0]
+				}
+			case <-ticker.C:
+				t.export(batch)
+				batch = batch[:0]
+			}
+		}
+	}()
+}
+
+// add queues the span, it's dropped if the queue is full or the tracer is stopped
+func (t *tracer) add(span otlpSpan) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		log.Printf("trace queue is full, span dropped")
+	}
+}
+
+// stop exports the queued spans
+func (t *tracer) stop(ctx context.Context) error {
+	t.mutex.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.queue)
+	}
+	t.mutex.Unlock()
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (t *tracer) export(spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(otlpExport{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", t.opts.ServiceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: DEFAULT_TRACE_SERVICE_NAME}, Spans: spans}},
+	}}})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if t.opts.Exporter == TRACE_EXPORTER_STDOUT {
+		os.Stdout.Write(append(body, '\n'))
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.opts.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	req.Header.Set("Content-Type", MIME_TYPE_JSON)
+	for k, v := range t.opts.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		log.Printf("trace export error: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		log.Printf("trace export error: %s", resp.Status)
+	}
+}
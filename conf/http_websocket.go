@@ -0,0 +1,261 @@
+package conf
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	PROTOCOL_HTTP      = "http"
+	PROTOCOL_WEBSOCKET = "websocket"
+
+	WEBSOCKET_WRITE_TIMEOUT = 5 * time.Second
+)
+
+type (
+	// WebSocketScript describes the message exchanges of a websocket route
+	WebSocketScript struct {
+		// messages sent on connect, strings are sent as they are, others in the format of the route
+		OnConnect []any `toml:"on_connect,omitempty"`
+		// replies to the incoming messages, the first matched one is used
+		Replies []*WebSocketReply `toml:"reply,omitempty"`
+		// milliseconds between the pushes of the items in data, 0 means no push
+		PushInterval int64 `toml:"push_interval,omitempty"`
+		// start over when all the items are pushed
+		PushLoop bool `toml:"push_loop,omitempty"`
+		// milliseconds before the server closes the connection, 0 means never
+		CloseAfter  int64  `toml:"close_after,omitempty"`
+		CloseCode   int    `toml:"close_code,omitempty"`
+		CloseReason string `toml:"close_reason,omitempty"`
+	}
+
+	WebSocketReply struct {
+		// match the incoming json message by field value, or the raw message by regex
+		MatchField string `toml:"match_field,omitempty"`
+		MatchValue string `toml:"match_value,omitempty"`
+		MatchRegex string `toml:"match_regex,omitempty"`
+		Send       []any  `toml:"send,omitempty"`
+		// close the connection after the reply if it's not 0
+		CloseCode   int    `toml:"close_code,omitempty"`
+		CloseReason string `toml:"close_reason,omitempty"`
+
+		regex *regexp.Regexp
+	}
+
+	// webSocketConn serializes the writes of the connection
+	webSocketConn struct {
+		*websocket.Conn
+		route Route
+		mutex sync.Mutex
+	}
+)
+
+var (
+	upgrader = websocket.Upgrader{
+		// it's a mock, any origin is welcome
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+)
+
+// compile checks the script and compiles the regexes of the replies
+func (script *WebSocketScript) compile() (err error) {
+	for _, reply := range script.Replies {
+		if reply.MatchRegex != "" {
+			if reply.regex, err = regexp.Compile(reply.MatchRegex); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// match checks the incoming message, decoded is nil if it's not in the format of the route
+func (reply *WebSocketReply) match(raw []byte, decoded map[string]any) bool {
+	if reply.regex != nil && !reply.regex.Match(raw) {
+		return false
+	}
+	if reply.MatchField != "" {
+		if decoded == nil {
+			return false
+		}
+		value, ok := decoded[reply.MatchField]
+		if !ok || (reply.MatchValue != "" && valueString(reflect.ValueOf(value)) != reply.MatchValue) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendData appends the items to the data of the route's data file
+func (route Route) appendData(items ...any) error {
+	defer route.lockFile()()
+
+	model, err := route.readModel()
+	if err != nil {
+		return err
+	}
+	model.Data = append(model.Data, items...)
+
+	bytes, err := route.Resolver.Marshal(model)
+	if err == nil {
+		err = os.WriteFile(route.File, bytes, 0666)
+	}
+	if err != nil {
+		metrics.fileError(route.File, FILE_OP_WRITE)
+		return err
+	}
+	metrics.items(route.File, len(model.Data))
+
+	hub.publish(route.File, items...)
+	return nil
+}
+
+func (conn *webSocketConn) send(msg any) error {
+	var bytes []byte
+	if s, ok := msg.(string); ok {
+		bytes = []byte(s)
+	} else {
+		var err error
+		if bytes, err = conn.route.Resolver.Marshal(msg); err != nil {
+			return err
+		}
+	}
+
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	return conn.WriteMessage(websocket.TextMessage, bytes)
+}
+
+func (conn *webSocketConn) close(code int, reason string) {
+	if code == 0 {
+		code = websocket.CloseNormalClosure
+	}
+
+	conn.mutex.Lock()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(WEBSOCKET_WRITE_TIMEOUT))
+	conn.mutex.Unlock()
+	conn.Close()
+}
+
+// push sends the matched items of the data file one by one at the interval
+func (conn *webSocketConn) push(values url.Values, done chan struct{}) {
+	script := conn.route.Script
+	ticker := time.NewTicker(time.Duration(script.PushInterval) * time.Millisecond)
+	defer ticker.Stop()
+
+	var items []any
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		if i == 0 || (i >= len(items) && script.PushLoop) {
+			i = 0
+			model, err := conn.route.readModel()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			items = conn.route.project(conn.route.matchQuery(model.Data, values))
+		}
+		if i >= len(items) {
+			return
+		}
+
+		if err := conn.send(items[i]); err != nil {
+			return
+		}
+	}
+}
+
+func (route Route) ServWebSocket(w http.ResponseWriter, r *http.Request, values url.Values) {
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has responded
+		log.Println(err)
+		return
+	}
+
+	conn := &webSocketConn{Conn: ws, route: route}
+	defer conn.Close()
+
+	script := route.Script
+	if script == nil {
+		script = &WebSocketScript{}
+	}
+
+	for _, msg := range script.OnConnect {
+		if err := conn.send(msg); err != nil {
+			return
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	if script.PushInterval > 0 {
+		go conn.push(values, done)
+	}
+
+	// the hijacked connection is not tracked by the server, close it when the server stops
+	go func() {
+		select {
+		case <-r.Context().Done():
+			conn.close(websocket.CloseGoingAway, "server stopping")
+		case <-done:
+		}
+	}()
+	if script.CloseAfter > 0 {
+		timer := time.AfterFunc(time.Duration(script.CloseAfter)*time.Millisecond, func() {
+			conn.close(script.CloseCode, script.CloseReason)
+		})
+		defer timer.Stop()
+	}
+
+	for {
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		// record the message like append does
+		var decoded map[string]any
+		if err := route.Resolver.Unmarshal(raw, &decoded); err == nil {
+			err = route.appendData(decoded)
+		} else {
+			decoded = nil
+			err = route.appendData(string(raw))
+		}
+		if err != nil {
+			log.Println(err)
+		}
+
+		for _, reply := range script.Replies {
+			if !reply.match(raw, decoded) {
+				continue
+			}
+
+			for _, msg := range reply.Send {
+				if err := conn.send(msg); err != nil {
+					return
+				}
+			}
+			if reply.CloseCode != 0 {
+				conn.close(reply.CloseCode, reply.CloseReason)
+				return
+			}
+			break
+		}
+	}
+}
@@ -4,13 +4,17 @@ go 1.21.1
 
 require (
 	github.com/BurntSushi/toml v1.3.2
+	github.com/gorilla/websocket v1.5.0
 	github.com/zddava/goext v0.0.0-20231002162456-d0d52ec494b3
 	github.com/zddava/gowrap v0.0.0-20231008072145-615e6a94b130
 	golang.org/x/exp v0.0.0-20230905200255-921286631fa9
+	golang.org/x/net v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
+	golang.org/x/text v0.13.0 // indirect
 )
@@ -1,25 +1,105 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/zddava/smock/build"
 	"github.com/zddava/smock/conf"
 )
 
+const (
+	COMMAND_SERVE    = "serve"
+	COMMAND_VALIDATE = "validate"
+	COMMAND_ROUTES   = "routes"
+	COMMAND_INIT     = "init"
+	COMMAND_IMPORT   = "import"
+
+	USAGE = `usage: smock [command] [flags] [args]
+
+commands:
+  serve      start the configured mocks, the default command
+  validate   check the configs and the data files
+  routes     print the static routes of the configs
+  init [dir] write a sample config and db_root to the dir, the default is the current one
+  import     import openapi|postman|har <file>, print the generated routes
+
+flags:
+`
+)
+
 var (
-	version = flag.Bool("v", false, "version")
+	version         = flag.Bool("v", false, "version")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "graceful shutdown timeout")
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), USAGE)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	if *version {
 		fmt.Println(build.ToString())
 		return
 	}
 
-	conf.ParseAndRun()
+	command, args := COMMAND_SERVE, flag.Args()
+	if len(args) > 0 {
+		// the flags can follow the command as well
+		command = args[0]
+		flag.CommandLine.Parse(args[1:])
+		args = flag.Args()
+	}
+
+	var err error
+	switch command {
+	case COMMAND_SERVE:
+		err = serve()
+	case COMMAND_VALIDATE:
+		err = conf.Validate(os.Stdout)
+	case COMMAND_ROUTES:
+		err = conf.Routes(os.Stdout)
+	case COMMAND_INIT:
+		dir := "."
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		if err = conf.Init(dir); err == nil {
+			log.Printf("sample config written to %s", dir)
+		}
+	case COMMAND_IMPORT:
+		err = conf.Import(args)
+	default:
+		flag.Usage()
+		err = fmt.Errorf("unknown command: %s", command)
+	}
+
+	if err != nil {
+		log.Printf("%s error: %s", command, err.Error())
+		os.Exit(1)
+	}
+}
+
+// serve starts the mocks and stops them on interrupt
+func serve() error {
+	if err := conf.ParseAndRun(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	log.Printf("shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
 
-	select {}
+	return conf.Stop(ctx)
 }
@@ -0,0 +1,257 @@
+// Package server embeds smock http servers, e.g. in go test
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/zddava/smock/conf"
+)
+
+const (
+	DEFAULT_CLOSE_TIMEOUT = 5 * time.Second
+
+	TEMP_DIR_PATTERN = "smock-"
+)
+
+var errServerClosed = errors.New("server closed")
+
+type (
+	// Option configures the server built by NewHttpServer
+	Option func(*options) error
+
+	options struct {
+		configFile string
+		fsys       fs.FS
+		dbRoot     string
+		port       int
+		routes     []conf.RouteInfo
+		files      map[string][]byte
+	}
+
+	// HttpServer is an embedded smock http server, it's also a http.Handler, e.g. for httptest.NewServer
+	HttpServer struct {
+		*conf.HttpServer
+
+		port    int
+		url     string
+		tempDir string
+		stubs   []*Stub
+		// a closed server can't be started again, e.g. its temp dir is removed
+		closed bool
+	}
+)
+
+// WithConfigFile loads the server from the config file, like the -http-server flag
+func WithConfigFile(file string) Option {
+	return func(o *options) error {
+		o.configFile = file
+		return nil
+	}
+}
+
+// WithFS copies the files to a temp dir, which the server works in, so that the data files written by the
+// requests are dropped on close, the config file is in the files if it's not empty, otherwise the files are the db_root
+func WithFS(fsys fs.FS, configFile string) Option {
+	return func(o *options) error {
+		o.fsys, o.configFile = fsys, configFile
+		return nil
+	}
+}
+
+// WithDBRoot sets the db_root if there is no config file, the default is a temp dir
+func WithDBRoot(dir string) Option {
+	return func(o *options) error {
+		o.dbRoot = dir
+		return nil
+	}
+}
+
+// WithPort listens on the port instead of a random one
+func WithPort(port int) Option {
+	return func(o *options) error {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid port: %d", port)
+		}
+		o.port = port
+		return nil
+	}
+}
+
+// WithRoute adds a static route, as a route section of the config file does
+func WithRoute(ri conf.RouteInfo) Option {
+	return func(o *options) error {
+		o.routes = append(o.routes, ri)
+		return nil
+	}
+}
+
+// WithFile writes a data file to the db_root before the server starts, the name is relative to the db_root
+func WithFile(name string, data []byte) Option {
+	return func(o *options) error {
+		if o.files == nil {
+			o.files = make(map[string][]byte)
+		}
+		o.files[name] = data
+		return nil
+	}
+}
+
+// NewHttpServer builds the server, it's started by Start or served by httptest
+func NewHttpServer(opts ...Option) (*HttpServer, error) {
+	o := &options{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+
+	server := &HttpServer{port: o.port}
+
+	dir := ""
+	if o.fsys != nil || (o.configFile == "" && o.dbRoot == "") {
+		tempDir, err := os.MkdirTemp("", TEMP_DIR_PATTERN)
+		if err != nil {
+			return nil, err
+		}
+		server.tempDir, dir = tempDir, tempDir
+	}
+
+	if err := server.load(o, dir); err != nil {
+		server.removeTempDir()
+		return nil, err
+	}
+	return server, nil
+}
+
+func (server *HttpServer) load(o *options, dir string) error {
+	if o.fsys != nil {
+		if err := copyFS(dir, o.fsys); err != nil {
+			return err
+		}
+	}
+
+	config, err := conf.LoadHttpServer(dir, o.configFile)
+	if err != nil {
+		return err
+	}
+	if o.configFile == "" {
+		config.DBRoot = dir
+		if o.dbRoot != "" {
+			config.DBRoot = o.dbRoot
+		}
+	}
+	server.HttpServer = config
+
+	for name, data := range o.files {
+		file := filepath.Join(config.DBRoot, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, data, 0o644); err != nil {
+			return err
+		}
+	}
+
+	for _, ri := range o.routes {
+		if err := config.AddRoute(ri); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFS copies the files to the dir
+func copyFS(dir string, fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(path))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+
+		data, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0o644)
+	})
+}
+
+// Route adds a static route, it must be called before the server starts
+func (server *HttpServer) Route(ri conf.RouteInfo) error {
+	if server.closed {
+		return errServerClosed
+	}
+	if server.url != "" {
+		return errors.New("server already started")
+	}
+	return server.AddRoute(ri)
+}
+
+// Start listens on a random port, or the one of WithPort, and returns the url of the server, e.g. http://127.0.0.1:12345
+func (server *HttpServer) Start() (string, error) {
+	if server.closed {
+		return "", errServerClosed
+	}
+	if server.url != "" {
+		return server.url, nil
+	}
+	for _, stub := range server.stubs {
+		if stub.err != nil {
+			return "", fmt.Errorf("stub %s: %w", stub, stub.err)
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(server.port))
+	if err != nil {
+		return "", err
+	}
+	server.Serve(ln)
+
+	scheme := "http"
+	if server.TLS() {
+		scheme = "https"
+	}
+	server.url = scheme + "://" + ln.Addr().String()
+	return server.url, nil
+}
+
+// URL returns the url of the started server, empty if it's not started
+func (server *HttpServer) URL() string {
+	return server.url
+}
+
+// Close stops the server and removes the temp dir, the server can't be started again
+func (server *HttpServer) Close() error {
+	if server.closed {
+		return nil
+	}
+	server.closed = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_CLOSE_TIMEOUT)
+	defer cancel()
+
+	err := server.Stop(ctx)
+	server.url = ""
+	return errors.Join(err, server.removeTempDir())
+}
+
+func (server *HttpServer) removeTempDir() error {
+	if server.tempDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(server.tempDir)
+	server.tempDir = ""
+	return err
+}
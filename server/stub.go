@@ -0,0 +1,241 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zddava/gowrap/json"
+	"github.com/zddava/smock/conf"
+)
+
+type (
+	// Stub builds a canned response of a route, e.g.
+	//
+	//	srv.On("POST", "/orders/{id}").WithJSONBody(match).Reply(201).JSON(obj).Times(2)
+	//
+	// the methods starting with With match the requests, the others describe the response
+	Stub struct {
+		method   string
+		path     string
+		stub     *conf.RouteStub
+		matchers []func(r *http.Request, values url.Values, body []byte) bool
+		// the expected calls, -1 if there is no expectation
+		expected int
+		// the least calls expected, 0 if there is no expectation
+		atLeast int
+		err     error
+	}
+)
+
+// NewTestServer builds the server for the test, the expectations of the stubs are verified
+// and the server is closed when the test finishes
+func NewTestServer(tb testing.TB, opts ...Option) *HttpServer {
+	tb.Helper()
+
+	server, err := NewHttpServer(opts...)
+	if err != nil {
+		tb.Fatalf("smock: %s", err.Error())
+	}
+
+	tb.Cleanup(func() {
+		server.Verify(tb)
+		if err := server.Close(); err != nil {
+			tb.Errorf("smock: %s", err.Error())
+		}
+	})
+	return server
+}
+
+// On stubs the requests of the method, GET, POST, PUT or DELETE, and the path, which can be a template like /orders/{id},
+// the stubs of a route are tried in order, the data file responds if none of them matches,
+// it must be called before the server starts
+func (server *HttpServer) On(method string, path string) *Stub {
+	stub := &Stub{method: method, path: path, stub: &conf.RouteStub{Header: make(http.Header)}, expected: -1}
+	stub.stub.Match = stub.match
+	server.stubs = append(server.stubs, stub)
+
+	if server.url != "" {
+		stub.err = fmt.Errorf("%s %s: server already started", method, path)
+	} else {
+		stub.err = server.AddStub(conf.RouteInfo{Path: path, Method: method}, stub.stub)
+	}
+	return stub
+}
+
+func (stub *Stub) match(r *http.Request, values url.Values, body []byte) bool {
+	for _, matcher := range stub.matchers {
+		if !matcher(r, values, body) {
+			return false
+		}
+	}
+	return true
+}
+
+// WithHeader matches the requests with the header
+func (stub *Stub) WithHeader(name string, value string) *Stub {
+	stub.matchers = append(stub.matchers, func(r *http.Request, values url.Values, body []byte) bool {
+		return r.Header.Get(name) == value
+	})
+	return stub
+}
+
+// WithQuery matches the requests with the query parameter or the path variable
+func (stub *Stub) WithQuery(name string, value string) *Stub {
+	stub.matchers = append(stub.matchers, func(r *http.Request, values url.Values, body []byte) bool {
+		for _, v := range values[name] {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	})
+	return stub
+}
+
+// WithJSONBody matches the requests whose json body contains the fields of v, the arrays must be equal
+func (stub *Stub) WithJSONBody(v any) *Stub {
+	expected, err := toJsonValue(v)
+	if err != nil && stub.err == nil {
+		stub.err = err
+	}
+
+	stub.matchers = append(stub.matchers, func(r *http.Request, values url.Values, body []byte) bool {
+		var actual any
+		if err := json.Unmarshal(body, &actual); err != nil {
+			return false
+		}
+		return jsonContains(actual, expected)
+	})
+	return stub
+}
+
+// WithMatch matches the requests by the function
+func (stub *Stub) WithMatch(match func(r *http.Request, body []byte) bool) *Stub {
+	stub.matchers = append(stub.matchers, func(r *http.Request, values url.Values, body []byte) bool {
+		return match(r, body)
+	})
+	return stub
+}
+
+// Reply sets the status of the response, the default is 200
+func (stub *Stub) Reply(status int) *Stub {
+	stub.stub.Status = status
+	return stub
+}
+
+// Header adds a header to the response
+func (stub *Stub) Header(name string, value string) *Stub {
+	stub.stub.Header.Add(name, value)
+	return stub
+}
+
+// JSON sets the response body to the json of v
+func (stub *Stub) JSON(v any) *Stub {
+	body, err := json.Marshal(v)
+	if err != nil && stub.err == nil {
+		stub.err = err
+	}
+
+	stub.stub.Body = body
+	stub.stub.Header.Set("Content-Type", conf.MIME_TYPE_JSON)
+	return stub
+}
+
+// Body sets the response body
+func (stub *Stub) Body(body []byte) *Stub {
+	stub.stub.Body = body
+	return stub
+}
+
+// Delay delays the response
+func (stub *Stub) Delay(d time.Duration) *Stub {
+	stub.stub.Delay = d
+	return stub
+}
+
+// Times expects the stub to respond n requests, the requests after them are responded by the next stub
+// or the data file, and fail Verify, a stub without Times or AtLeastOnce is not verified
+func (stub *Stub) Times(n int) *Stub {
+	stub.stub.Times, stub.expected, stub.atLeast = n, n, 0
+	return stub
+}
+
+// Once is Times(1)
+func (stub *Stub) Once() *Stub {
+	return stub.Times(1)
+}
+
+// AtLeastOnce expects the stub to respond one request or more, without a limit
+func (stub *Stub) AtLeastOnce() *Stub {
+	stub.stub.Times, stub.expected, stub.atLeast = 0, -1, 1
+	return stub
+}
+
+// Calls returns how many requests the stub responded
+func (stub *Stub) Calls() int {
+	return stub.stub.Calls()
+}
+
+func (stub *Stub) String() string {
+	return stub.method + " " + stub.path
+}
+
+// Verify fails the test if a stub is invalid or its expected calls are not met
+func (server *HttpServer) Verify(tb testing.TB) {
+	tb.Helper()
+
+	for _, stub := range server.stubs {
+		if stub.err != nil {
+			tb.Errorf("smock: stub %s: %s", stub, stub.err.Error())
+		} else if calls := stub.Calls() + stub.stub.Overflow(); stub.expected >= 0 && calls != stub.expected {
+			tb.Errorf("smock: stub %s: expected %d call(s), got %d", stub, stub.expected, calls)
+		} else if calls := stub.Calls(); calls < stub.atLeast {
+			tb.Errorf("smock: stub %s: expected at least %d call(s), got %d", stub, stub.atLeast, calls)
+		}
+	}
+}
+
+// toJsonValue converts v to what json.Unmarshal produces, so that it can be compared with the bodies
+func toJsonValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var value any
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
+
+// jsonContains checks whether the actual value contains the fields of the expected one
+func jsonContains(actual any, expected any) bool {
+	switch e := expected.(type) {
+	case map[string]any:
+		a, ok := actual.(map[string]any)
+		if !ok {
+			return false
+		}
+		for k, v := range e {
+			if av, ok := a[k]; !ok || !jsonContains(av, v) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		a, ok := actual.([]any)
+		if !ok || len(a) != len(e) {
+			return false
+		}
+		for i := range e {
+			if !jsonContains(a[i], e[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(actual, expected)
+}
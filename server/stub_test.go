@@ -0,0 +1,278 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fakeTB records the errors of Verify instead of failing the test
+type fakeTB struct {
+	testing.TB
+	errors []string
+}
+
+func (tb *fakeTB) Helper() {}
+
+func (tb *fakeTB) Errorf(format string, args ...any) {
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+func startServer(t *testing.T, srv *HttpServer) string {
+	t.Helper()
+
+	url, err := srv.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return url
+}
+
+func newServer(t *testing.T) *HttpServer {
+	t.Helper()
+
+	srv, err := NewHttpServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func send(t *testing.T, method string, url string, body string) (int, http.Header, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header, string(data)
+}
+
+func TestStubReply(t *testing.T) {
+	srv := NewTestServer(t)
+	srv.On("POST", "/orders/{id}").
+		WithJSONBody(map[string]any{"qty": 2}).
+		WithQuery("id", "7").
+		Reply(http.StatusCreated).
+		Header("X-Order", "7").
+		JSON(map[string]any{"ok": true}).
+		Times(2)
+	url := startServer(t, srv)
+
+	for i := 0; i < 2; i++ {
+		status, header, body := send(t, "POST", url+"/orders/7", `{"qty": 2, "note": "x"}`)
+		if status != http.StatusCreated {
+			t.Fatalf("status = %d, want %d", status, http.StatusCreated)
+		}
+		if got := header.Get("X-Order"); got != "7" {
+			t.Errorf("X-Order = %q, want 7", got)
+		}
+		if got := header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+		if body != `{"ok":true}` {
+			t.Errorf("body = %s", body)
+		}
+	}
+}
+
+func TestStubNotMatched(t *testing.T) {
+	srv := newServer(t)
+	stub := srv.On("POST", "/orders/{id}").WithJSONBody(map[string]any{"qty": 2}).Reply(http.StatusCreated)
+	url := startServer(t, srv)
+
+	for _, body := range []string{`{"qty": 3}`, `{}`, `not json`} {
+		if status, _, _ := send(t, "POST", url+"/orders/7", body); status == http.StatusCreated {
+			t.Errorf("%s: matched the stub", body)
+		}
+	}
+	if calls := stub.Calls(); calls != 0 {
+		t.Errorf("calls = %d, want 0", calls)
+	}
+}
+
+func TestStubsInOrder(t *testing.T) {
+	srv := newServer(t)
+	srv.On("GET", "/users").WithHeader("X-Role", "admin").Body([]byte("admin"))
+	srv.On("GET", "/users").Body([]byte("user"))
+	url := startServer(t, srv)
+
+	req, _ := http.NewRequest("GET", url+"/users", nil)
+	req.Header.Set("X-Role", "admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "admin" {
+		t.Errorf("body = %s, want admin", data)
+	}
+
+	if _, _, body := send(t, "GET", url+"/users", ""); body != "user" {
+		t.Errorf("body = %s, want user", body)
+	}
+}
+
+func TestVerifyTimes(t *testing.T) {
+	tests := []struct {
+		name     string
+		times    int
+		requests int
+		fail     bool
+	}{
+		{"met", 2, 2, false},
+		{"too few", 2, 1, true},
+		{"too many", 2, 3, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t)
+			stub := srv.On("GET", "/ping").Body([]byte("pong")).Times(tt.times)
+			url := startServer(t, srv)
+
+			for i := 0; i < tt.requests; i++ {
+				_, _, body := send(t, "GET", url+"/ping", "")
+				if want := i < tt.times; (body == "pong") != want {
+					t.Errorf("request %d: body = %q", i+1, body)
+				}
+			}
+			if calls := stub.Calls(); calls != min(tt.times, tt.requests) {
+				t.Errorf("calls = %d", calls)
+			}
+
+			tb := &fakeTB{}
+			srv.Verify(tb)
+			if fail := len(tb.errors) > 0; fail != tt.fail {
+				t.Errorf("verify errors = %v, want fail %v", tb.errors, tt.fail)
+			}
+		})
+	}
+}
+
+func TestVerifyInvalidStub(t *testing.T) {
+	srv := newServer(t)
+	srv.On("GET", "/bad").JSON(func() {})
+
+	if _, err := srv.Start(); err == nil {
+		t.Error("started with an invalid stub")
+	}
+
+	tb := &fakeTB{}
+	srv.Verify(tb)
+	if len(tb.errors) != 1 {
+		t.Errorf("verify errors = %v, want 1", tb.errors)
+	}
+}
+
+func TestStubAfterStart(t *testing.T) {
+	srv := newServer(t)
+	startServer(t, srv)
+	srv.On("GET", "/late")
+
+	tb := &fakeTB{}
+	srv.Verify(tb)
+	if len(tb.errors) != 1 {
+		t.Errorf("verify errors = %v, want 1", tb.errors)
+	}
+}
+
+func TestJsonContains(t *testing.T) {
+	tests := []struct {
+		name     string
+		actual   any
+		expected any
+		want     bool
+	}{
+		{"equal", map[string]any{"a": 1}, map[string]any{"a": 1}, true},
+		{"subset", map[string]any{"a": 1, "b": 2}, map[string]any{"a": 1}, true},
+		{"nested subset", map[string]any{"a": map[string]any{"b": 1, "c": 2}}, map[string]any{"a": map[string]any{"b": 1}}, true},
+		{"missing key", map[string]any{"a": 1}, map[string]any{"b": 1}, false},
+		{"different value", map[string]any{"a": 1}, map[string]any{"a": 2}, false},
+		{"not an object", []any{1}, map[string]any{"a": 1}, false},
+		{"equal array", []any{1, 2}, []any{1, 2}, true},
+		{"array of subsets", []any{map[string]any{"a": 1, "b": 2}}, []any{map[string]any{"a": 1}}, true},
+		{"longer array", []any{1, 2, 3}, []any{1, 2}, false},
+		{"array order", []any{2, 1}, []any{1, 2}, false},
+		{"scalar", "x", "x", true},
+		{"scalar type", "1", float64(1), false},
+		{"null", nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := toJsonValue(tt.actual)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, err := toJsonValue(tt.expected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := jsonContains(actual, expected); got != tt.want {
+				t.Errorf("jsonContains(%v, %v) = %v, want %v", actual, expected, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStubUnsupportedMethod(t *testing.T) {
+	srv := newServer(t)
+	srv.On("PATCH", "/items/{id}")
+
+	tb := &fakeTB{}
+	srv.Verify(tb)
+	if len(tb.errors) != 1 || !strings.Contains(tb.errors[0], "unsupported method") {
+		t.Errorf("verify errors = %v, want an unsupported method", tb.errors)
+	}
+}
+
+func TestVerifyAtLeastOnce(t *testing.T) {
+	for _, requests := range []int{0, 1, 3} {
+		t.Run(fmt.Sprint(requests), func(t *testing.T) {
+			srv := newServer(t)
+			srv.On("GET", "/ping").Body([]byte("pong")).AtLeastOnce()
+			url := startServer(t, srv)
+
+			for i := 0; i < requests; i++ {
+				if _, _, body := send(t, "GET", url+"/ping", ""); body != "pong" {
+					t.Errorf("request %d: body = %q", i+1, body)
+				}
+			}
+
+			tb := &fakeTB{}
+			srv.Verify(tb)
+			if fail := len(tb.errors) > 0; fail != (requests == 0) {
+				t.Errorf("verify errors = %v", tb.errors)
+			}
+		})
+	}
+}
+
+func TestVerifyWithoutExpectation(t *testing.T) {
+	srv := newServer(t)
+	srv.On("GET", "/ping").Body([]byte("pong"))
+	startServer(t, srv)
+
+	tb := &fakeTB{}
+	srv.Verify(tb)
+	if len(tb.errors) != 0 {
+		t.Errorf("verify errors = %v, want none", tb.errors)
+	}
+}